@@ -3,13 +3,20 @@ package main
 import (
 	"context"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/johanneswuerbach/jaeger-s3/plugin"
 	pConfig "github.com/johanneswuerbach/jaeger-s3/plugin/config"
 	"github.com/ory/viper"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/pflag"
+	"github.com/uber/jaeger-lib/metrics"
+	jaegerprometheus "github.com/uber/jaeger-lib/metrics/prometheus"
 
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/plugin/storage/grpc"
@@ -21,7 +28,10 @@ import (
 )
 
 const (
-	loggerName = "jaeger-s3"
+	loggerName       = "jaeger-s3"
+	metricsNamespace = "jaeger_s3"
+
+	defaultShutdownTimeout = 30 * time.Second
 )
 
 func main() {
@@ -69,6 +79,14 @@ func main() {
 
 	ctx := context.TODO()
 
+	shutdownTimeout := defaultShutdownTimeout
+	if configuration.ShutdownTimeout != "" {
+		shutdownTimeout, err = time.ParseDuration(configuration.ShutdownTimeout)
+		if err != nil {
+			log.Fatalf("unable to parse shutdown timeout, %v", err)
+		}
+	}
+
 	cfg, err := config.LoadDefaultConfig(ctx, func(lo *config.LoadOptions) error {
 		return nil
 	})
@@ -76,19 +94,75 @@ func main() {
 		log.Fatalf("unable to load SDK config, %v", err)
 	}
 
-	s3Svc := s3.NewFromConfig(cfg)
+	s3Svc := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		// Allow using S3 compatible services like MinIO
+		if configuration.S3.Endpoint != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(configuration.S3.Endpoint)
+		}
+		o.UsePathStyle = configuration.S3.UsePathStyle
+	})
 	athenaSvc := athena.NewFromConfig(cfg)
 
 	logger.Debug("plugin configured")
 
-	s3Plugin, err := plugin.NewS3Plugin(ctx, logger, s3Svc, configuration.S3, athenaSvc, configuration.Athena)
+	metricsFactory := metrics.NullFactory
+	if configuration.Admin.HTTPHostPort != "" {
+		metricsFactory = jaegerprometheus.New().Namespace(metrics.NSOptions{Name: metricsNamespace})
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+
+		go func() {
+			if err := http.ListenAndServe(configuration.Admin.HTTPHostPort, mux); err != nil {
+				logger.Error("admin http server failed", "error", err)
+			}
+		}()
+	}
+
+	s3Plugin, err := plugin.NewS3Plugin(ctx, logger, metricsFactory, s3Svc, configuration.S3, athenaSvc, configuration.Athena, configuration.DuckDB, configuration.Trino, configuration.Partitioning)
 	if err != nil {
 		log.Fatalf("unable to create plugin, %v", err)
 	}
 
+	// Flush open parquet files on shutdown, both when Jaeger stops the plugin and when the process
+	// is terminated. Shutting down twice is safe. Returns false when spans got lost or are only
+	// stored in the spill directory.
+	shutdown := func() bool {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		stats, err := s3Plugin.Shutdown(shutdownCtx)
+		if err != nil {
+			logger.Error("failed to shut down plugin", "error", err)
+			return false
+		}
+
+		return stats.RowsUnflushed() == 0 && stats.FilesFailed == 0 && stats.FilesSpilled == 0
+	}
+
+	// Exit non-zero when spans got lost or weren't uploaded, so orchestrators can tell a lossy shutdown apart
+	exit := func() {
+		if !shutdown() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		logger.Info("received signal, shutting down", "signal", sig.String())
+
+		exit()
+	}()
+
 	logger.Debug("plugin created")
 	grpc.Serve(&shared.PluginServices{
 		Store:               s3Plugin,
+		ArchiveStore:        s3Plugin,
 		StreamingSpanWriter: s3Plugin,
 	})
+
+	exit()
 }
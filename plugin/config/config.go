@@ -9,6 +9,52 @@ type S3 struct {
 	OperationsDedupeDuration              string
 	OperationsDedupeRewriteBufferDuration string
 	OperationsDedupeCacheSize             int
+	ArchiveSpansPrefix                    string
+	// Endpoint and UsePathStyle allow using S3 compatible services like MinIO
+	Endpoint     string
+	UsePathStyle bool
+	// LocalDirectory writes parquet files into a local directory instead of S3
+	LocalDirectory string
+	// InstanceID is part of every parquet file name, defaults to the hostname. Must be unique per
+	// running instance.
+	InstanceID string
+	// SpillDirectory writes parquet files into a local directory before uploading them to S3.
+	// Failed uploads are retried from there and replayed on startup. Every file is written to
+	// local disk first, so the directory needs to fit all open and spilled files.
+	SpillDirectory string
+	// MaxFileRows and MaxFileBytes (approximate uncompressed size) rotate parquet files before
+	// the buffer duration elapsed. Zero values disable the thresholds.
+	MaxFileRows  int64
+	MaxFileBytes int64
+	// MaxConcurrentFlushes bounds the number of parquet files uploaded in parallel per writer, defaults to 4
+	MaxConcurrentFlushes int
+	// MaxBufferedBytes bounds the approximate memory used by spans, which haven't been uploaded yet.
+	// Zero disables the limit.
+	MaxBufferedBytes int64
+	// BufferFullPolicy is applied once MaxBufferedBytes is exhausted, one of "block" (default),
+	// "drop_oldest" or "error"
+	BufferFullPolicy string
+	// CompressionCodec of parquet files, one of "snappy" (default), "zstd", "gzip" or "none"
+	CompressionCodec string
+	// RowGroupSize and PageSize of parquet files in bytes, default to 128MB (8MB with SortSpans) and 8KB
+	RowGroupSize int64
+	PageSize     int64
+	// SortSpans writes spans ordered by trace id and start time, so trace lookups can skip row
+	// groups using the column statistics. All spans of a file are buffered until it is closed and
+	// count against MaxBufferedBytes. Row groups can't exceed 32MB.
+	SortSpans bool
+	// WriterConcurrency is the number of goroutines marshalling rows per parquet file, defaults to 1
+	WriterConcurrency int64
+	// IndexedTags limits the searchable tags, process tags and log fields to the given keys,
+	// ExcludedTags are never searchable. Values longer than MaxTagValueLength aren't searchable
+	// either. Filtered tags are still part of the span payload.
+	IndexedTags       []string
+	ExcludedTags      []string
+	MaxTagValueLength int
+	// PromotedTags are additionally written into a dedicated dictionary encoded column per tag key,
+	// e.g. tag_http_status_code for http.status_code. The spans tables need to contain the columns,
+	// which are additionally matched when searching the tags.
+	PromotedTags []string
 }
 
 type Athena struct {
@@ -22,9 +68,62 @@ type Athena struct {
 	ServicesQueryTTL     string
 	MaxTraceDuration     string
 	DependenciesPrefetch bool
+
+	ArchiveSpansTableName string
+	ArchiveMaxSpanAge     string
+
+	// PricePerTerabyte scanned is used to estimate the cost of queries, defaults to 5 (USD)
+	PricePerTerabyte float64
+	// MaxQueryRetries of queries failing due to transient errors, defaults to 2. Negative values disable retries.
+	MaxQueryRetries int
+}
+
+// DuckDB allows querying parquet files written into a local directory using an embedded DuckDB
+// instead of Athena. Requires the plugin to be built with the `duckdb` build tag.
+type DuckDB struct {
+	Directory string
+}
+
+// Trino allows querying the tables using a self-hosted Trino (or Presto) coordinator
+// instead of Athena. The table names are configured in the Athena section.
+type Trino struct {
+	// Endpoint of the coordinator, e.g. http://trino:8080
+	Endpoint string
+	User     string
+	// Password is sent using basic auth, which Trino only accepts over https
+	Password string
+	Catalog  string
+	Schema   string
+}
+
+// Partitioning configures the datehour partition of the parquet files. The partition projection
+// of the tables needs to use the same granularity.
+type Partitioning struct {
+	// Granularity of partitions, one of "hour" (default), "day" or "15m"
+	Granularity string
+	// ServiceName adds a service_partition level below the datehour partition of the spans and
+	// operations tables, so queries scoped to a service only read the files of that service.
+	ServiceName bool
+	// ServiceNames get their own service partition and are required with ServiceName. Spans of other
+	// services are written into the shared _other partition. Must match the enumerated values of the
+	// service_partition projection.
+	ServiceNames []string
+}
+
+// Admin configures the admin HTTP server exposing Prometheus metrics on /metrics.
+// The server is disabled when no host port is configured.
+type Admin struct {
+	HTTPHostPort string
 }
 
 type Configuration struct {
-	S3     S3
-	Athena Athena
+	S3           S3
+	Athena       Athena
+	DuckDB       DuckDB
+	Trino        Trino
+	Partitioning Partitioning
+	Admin        Admin
+
+	// ShutdownTimeout bounds the time spent flushing all open parquet files on shutdown, defaults to 30s
+	ShutdownTimeout string
 }
@@ -4,6 +4,9 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/athena"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
@@ -13,38 +16,115 @@ import (
 	"github.com/jaegertracing/jaeger/storage/spanstore"
 	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
 	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore"
+	"github.com/uber/jaeger-lib/metrics"
 	"golang.org/x/sync/errgroup"
 )
 
+const (
+	// shutdownCancelGracePeriod is the time given to cancelled uploads to clean up, after the
+	// shutdown deadline exceeded
+	shutdownCancelGracePeriod = 5 * time.Second
+)
+
 var (
 	_ shared.StoragePlugin             = (*S3Plugin)(nil)
+	_ shared.ArchiveStoragePlugin      = (*S3Plugin)(nil)
 	_ shared.StreamingSpanWriterPlugin = (*S3Plugin)(nil)
 	_ io.Closer                        = (*S3Plugin)(nil)
 )
 
-func NewS3Plugin(ctx context.Context, logger hclog.Logger, s3Svc *s3.Client, s3Config config.S3, athenaSvc *athena.Client, athenaConfig config.Athena) (*S3Plugin, error) {
-	spanWriter, err := s3spanstore.NewWriter(ctx, logger, s3Svc, s3Config)
+func NewS3Plugin(ctx context.Context, logger hclog.Logger, metricsFactory metrics.Factory, s3Svc *s3.Client, s3Config config.S3, athenaSvc *athena.Client, athenaConfig config.Athena, duckDBConfig config.DuckDB, trinoConfig config.Trino, partitioningConfig config.Partitioning) (*S3Plugin, error) {
+	partitions, err := s3spanstore.NewPartitionScheme(partitioningConfig)
 	if err != nil {
+		return nil, fmt.Errorf("failed to create partition scheme, %v", err)
+	}
+
+	// Cancelled once the shutdown deadline exceeded, aborting pending uploads
+	ctx, cancel := context.WithCancel(ctx)
+
+	spanWriter, err := s3spanstore.NewWriter(ctx, logger, metricsFactory, s3Svc, s3Config, partitions)
+	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("failed to create span writer, %v", err)
 	}
 
-	spanReader, err := s3spanstore.NewReader(ctx, logger, athenaSvc, athenaConfig)
+	queryEngine, err := newQueryEngine(ctx, logger, metricsFactory, partitions, s3Config, athenaSvc, athenaConfig, duckDBConfig, trinoConfig)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create query engine, %v", err)
+	}
+
+	spanReader, err := s3spanstore.NewReaderWithQueryEngine(ctx, logger, queryEngine, athenaConfig, partitions, s3Config.PromotedTags)
 	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("failed to create span reader, %v", err)
 	}
 
-	return &S3Plugin{
-		spanWriter: spanWriter,
-		spanReader: spanReader,
-		logger:     logger,
-	}, nil
+	s3Plugin := &S3Plugin{
+		spanWriter:        spanWriter,
+		spanReader:        spanReader,
+		queryEngine:       queryEngine,
+		logger:            logger,
+		cancel:            cancel,
+		cancelGracePeriod: shutdownCancelGracePeriod,
+	}
+
+	// Archiving is only enabled, when both the archive prefix and table are configured
+	if s3Config.ArchiveSpansPrefix != "" && athenaConfig.ArchiveSpansTableName != "" {
+		archiveSpanWriter, err := s3spanstore.NewArchiveWriter(ctx, logger, metricsFactory.Namespace(metrics.NSOptions{Name: "archive"}), s3Svc, s3Config, partitions)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("failed to create archive span writer, %v", err)
+		}
+
+		archiveSpanReader, err := s3spanstore.NewArchiveReaderWithQueryEngine(ctx, logger, queryEngine, athenaConfig, partitions, s3Config.PromotedTags)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("failed to create archive span reader, %v", err)
+		}
+
+		s3Plugin.archiveSpanWriter = archiveSpanWriter
+		s3Plugin.archiveSpanReader = archiveSpanReader
+	}
+
+	return s3Plugin, nil
+}
+
+// newQueryEngine uses DuckDB or Trino when configured and Athena otherwise
+func newQueryEngine(ctx context.Context, logger hclog.Logger, metricsFactory metrics.Factory, partitions s3spanstore.PartitionScheme, s3Config config.S3, athenaSvc *athena.Client, athenaConfig config.Athena, duckDBConfig config.DuckDB, trinoConfig config.Trino) (s3spanstore.QueryEngine, error) {
+	if trinoConfig.Endpoint != "" {
+		return s3spanstore.NewTrinoQueryEngine(logger, metricsFactory, &http.Client{}, trinoConfig), nil
+	}
+
+	if duckDBConfig.Directory == "" {
+		return s3spanstore.NewAthenaQueryEngine(logger, metricsFactory, athenaSvc, athenaConfig), nil
+	}
+
+	tables := map[string]s3spanstore.DuckDBTable{
+		athenaConfig.SpansTableName:      {Prefix: s3Config.SpansPrefix, Partitions: partitions},
+		athenaConfig.OperationsTableName: {Prefix: s3Config.OperationsPrefix, Partitions: partitions},
+	}
+	if athenaConfig.ArchiveSpansTableName != "" {
+		tables[athenaConfig.ArchiveSpansTableName] = s3spanstore.DuckDBTable{Prefix: s3Config.ArchiveSpansPrefix, Partitions: partitions.WithoutServiceName()}
+	}
+
+	return s3spanstore.NewDuckDBQueryEngine(ctx, logger, duckDBConfig.Directory, tables)
 }
 
 type S3Plugin struct {
-	spanWriter *s3spanstore.Writer
-	spanReader *s3spanstore.Reader
+	spanWriter        *s3spanstore.Writer
+	spanReader        *s3spanstore.Reader
+	archiveSpanWriter *s3spanstore.ArchiveWriter
+	archiveSpanReader *s3spanstore.Reader
+	queryEngine       s3spanstore.QueryEngine
 
 	logger hclog.Logger
+	cancel context.CancelFunc
+	// cancelGracePeriod is the time given to cancelled uploads to clean up
+	cancelGracePeriod time.Duration
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
 func (h *S3Plugin) SpanWriter() spanstore.Writer {
@@ -63,11 +143,99 @@ func (h *S3Plugin) StreamingSpanWriter() spanstore.Writer {
 	return h.spanWriter
 }
 
+// ArchiveSpanReader returns nil when archiving isn't configured, which is used by
+// Jaeger to determine the archive capabilities of the plugin.
+func (h *S3Plugin) ArchiveSpanReader() spanstore.Reader {
+	if h.archiveSpanReader == nil {
+		return nil
+	}
+
+	return h.archiveSpanReader
+}
+
+// ArchiveSpanWriter returns nil when archiving isn't configured.
+func (h *S3Plugin) ArchiveSpanWriter() spanstore.Writer {
+	if h.archiveSpanWriter == nil {
+		return nil
+	}
+
+	return h.archiveSpanWriter
+}
+
+// Shutdown flushes all writers and closes the plugin. Once ctx is done pending uploads are cancelled
+// and Shutdown returns shortly after, reporting the spans which couldn't be flushed. It is safe to
+// call Shutdown and Close multiple times.
+func (h *S3Plugin) Shutdown(ctx context.Context) (s3spanstore.FlushStats, error) {
+	closed := make(chan error, 1)
+	go func() {
+		closed <- h.Close()
+	}()
+
+	var err error
+	select {
+	case err = <-closed:
+	case <-ctx.Done():
+		h.logger.Warn("shutdown deadline exceeded, cancelling pending uploads")
+		h.cancel()
+
+		select {
+		case <-closed:
+		case <-time.After(h.cancelGracePeriod):
+		}
+		err = fmt.Errorf("failed to flush writers before the shutdown deadline: %w", ctx.Err())
+	}
+
+	stats := h.FlushStats()
+	if stats.RowsUnflushed() > 0 || stats.FilesFailed > 0 {
+		h.logger.Warn("plugin shut down with unflushed spans", "spansFlushed", stats.RowsFlushed, "spansSpilled", stats.RowsSpilled, "spansLost", stats.RowsUnflushed(), "filesFlushed", stats.FilesFlushed, "filesSpilled", stats.FilesSpilled, "filesFailed", stats.FilesFailed)
+	} else if stats.FilesSpilled > 0 {
+		// Spilled files are only stored locally, until they are uploaded on the next startup
+		h.logger.Warn("plugin shut down with spilled spans, which are uploaded on the next startup", "spansFlushed", stats.RowsFlushed, "spansSpilled", stats.RowsSpilled, "filesFlushed", stats.FilesFlushed, "filesSpilled", stats.FilesSpilled)
+	} else {
+		h.logger.Info("plugin shut down", "spansFlushed", stats.RowsFlushed, "filesFlushed", stats.FilesFlushed)
+	}
+
+	return stats, err
+}
+
+// FlushStats counts spans of the span and archive writers
+func (h *S3Plugin) FlushStats() s3spanstore.FlushStats {
+	stats := h.spanWriter.FlushStats()
+	if h.archiveSpanWriter != nil {
+		stats = stats.Add(h.archiveSpanWriter.FlushStats())
+	}
+
+	return stats
+}
+
+// Close flushes all writers without a deadline, subsequent calls return the result of the first call
 func (h *S3Plugin) Close() error {
+	h.closeOnce.Do(func() {
+		h.closeErr = h.close()
+		h.cancel()
+	})
+
+	return h.closeErr
+}
+
+func (h *S3Plugin) close() error {
 	g := errgroup.Group{}
 
 	g.Go(h.spanWriter.Close)
 	g.Go(h.spanReader.Close)
 
-	return g.Wait()
+	if h.archiveSpanWriter != nil {
+		g.Go(h.archiveSpanWriter.Close)
+	}
+
+	if h.archiveSpanReader != nil {
+		g.Go(h.archiveSpanReader.Close)
+	}
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	// The query engine is shared between readers, so close it last
+	return h.queryEngine.Close()
 }
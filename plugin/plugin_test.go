@@ -0,0 +1,164 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-lib/metrics"
+)
+
+// blockingS3 blocks uploads until release is closed. Uploads are only cancelled, when honorCancel is set.
+type blockingS3 struct {
+	s3spanstore.S3API
+
+	honorCancel bool
+	release     chan struct{}
+}
+
+func (s *blockingS3) PutObject(ctx context.Context, _ *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if s.honorCancel {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.release:
+		}
+	} else {
+		<-s.release
+	}
+
+	return &s3.PutObjectOutput{}, nil
+}
+
+func NewTestS3Plugin(assert *assert.Assertions, svc s3spanstore.S3API) *S3Plugin {
+	return NewTestS3PluginWithConfig(assert, svc, config.S3{
+		BucketName:       "jaeger-spans",
+		SpansPrefix:      "spans/",
+		OperationsPrefix: "operations/",
+	})
+}
+
+func NewTestS3PluginWithConfig(assert *assert.Assertions, svc s3spanstore.S3API, s3Config config.S3) *S3Plugin {
+	logger := hclog.NewNullLogger()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	spanWriter, err := s3spanstore.NewWriter(ctx, logger, metrics.NullFactory, svc, s3Config, s3spanstore.PartitionScheme{})
+	assert.NoError(err)
+
+	queryEngine := s3spanstore.NewTrinoQueryEngine(logger, metrics.NullFactory, &http.Client{}, config.Trino{Endpoint: "http://localhost:8080"})
+
+	spanReader, err := s3spanstore.NewReaderWithQueryEngine(ctx, logger, queryEngine, config.Athena{
+		SpansTableName:      "jaeger_spans",
+		OperationsTableName: "jaeger_operations",
+		MaxSpanAge:          "336h",
+	}, s3spanstore.PartitionScheme{}, nil)
+	assert.NoError(err)
+
+	return &S3Plugin{
+		spanWriter:        spanWriter,
+		spanReader:        spanReader,
+		queryEngine:       queryEngine,
+		logger:            logger,
+		cancel:            cancel,
+		cancelGracePeriod: shutdownCancelGracePeriod,
+	}
+}
+
+func writeTestSpan(assert *assert.Assertions, s3Plugin *S3Plugin) {
+	assert.NoError(s3Plugin.SpanWriter().WriteSpan(context.TODO(), &model.Span{
+		TraceID:       model.NewTraceID(1, 1),
+		SpanID:        model.NewSpanID(1),
+		OperationName: "operation",
+		StartTime:     time.Now(),
+		Process:       &model.Process{ServiceName: "service"},
+	}))
+}
+
+func TestS3PluginShutdownCancelsUploadsAfterDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := &blockingS3{honorCancel: true, release: make(chan struct{})}
+	defer close(svc.release)
+
+	s3Plugin := NewTestS3Plugin(assert, svc)
+	writeTestSpan(assert, s3Plugin)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	stats, err := s3Plugin.Shutdown(ctx)
+	assert.ErrorIs(err, context.DeadlineExceeded)
+
+	// The cancelled uploads finish within the grace period
+	assert.Less(time.Since(start), shutdownCancelGracePeriod)
+	assert.Equal(int64(1), stats.RowsUnflushed())
+}
+
+func TestS3PluginShutdownGivesUpAfterGracePeriod(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := &blockingS3{release: make(chan struct{})}
+	defer close(svc.release)
+
+	s3Plugin := NewTestS3Plugin(assert, svc)
+	s3Plugin.cancelGracePeriod = 10 * time.Millisecond
+	writeTestSpan(assert, s3Plugin)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// Uploads ignoring the cancellation don't block the shutdown
+	stats, err := s3Plugin.Shutdown(ctx)
+	assert.ErrorIs(err, context.DeadlineExceeded)
+	assert.Equal(int64(1), stats.RowsUnflushed())
+}
+
+func TestS3PluginShutdownReportsSpilledSpans(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := &blockingS3{honorCancel: true, release: make(chan struct{})}
+	defer close(svc.release)
+
+	s3Plugin := NewTestS3PluginWithConfig(assert, svc, config.S3{
+		BucketName:       "jaeger-spans",
+		SpansPrefix:      "spans/",
+		OperationsPrefix: "operations/",
+		SpillDirectory:   t.TempDir(),
+	})
+	writeTestSpan(assert, s3Plugin)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// The cancelled upload stays in the spill directory, so the span isn't lost but also not flushed
+	stats, err := s3Plugin.Shutdown(ctx)
+	assert.ErrorIs(err, context.DeadlineExceeded)
+	assert.Equal(int64(0), stats.RowsUnflushed())
+	assert.Equal(int64(0), stats.RowsFlushed)
+	assert.Equal(int64(1), stats.RowsSpilled)
+	assert.Equal(int64(1), stats.FilesSpilled)
+}
+
+func TestS3PluginShutdown(t *testing.T) {
+	assert := assert.New(t)
+
+	svc := &blockingS3{release: make(chan struct{})}
+	close(svc.release)
+
+	s3Plugin := NewTestS3Plugin(assert, svc)
+	writeTestSpan(assert, s3Plugin)
+
+	stats, err := s3Plugin.Shutdown(context.Background())
+	assert.NoError(err)
+	assert.Equal(int64(0), stats.RowsUnflushed())
+	assert.Equal(int64(1), stats.RowsFlushed)
+}
@@ -0,0 +1,127 @@
+package s3spanstore
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/uber/jaeger-lib/metrics"
+)
+
+var (
+	defaultArchiveMaxSpanAge = time.Hour * 24 * 365
+)
+
+// ArchiveWriter writes spans archived via the Jaeger UI into a separate prefix, so they
+// can be retained independently from regular spans.
+type ArchiveWriter struct {
+	logger  hclog.Logger
+	metrics *WriterMetrics
+
+	sink              ParquetFileSink
+	spanParquetWriter IParquetWriter
+	tagFilter         *TagFilter
+}
+
+func NewArchiveWriter(ctx context.Context, logger hclog.Logger, metricsFactory metrics.Factory, svc S3API, s3Config config.S3, partitions PartitionScheme) (*ArchiveWriter, error) {
+	parquetWriterOpts, err := NewParquetWriterOptions(s3Config)
+	if err != nil {
+		return nil, err
+	}
+	// Archived traces are only looked up by trace id, so they aren't partitioned by service
+	parquetWriterOpts.Partitions = partitions.WithoutServiceName()
+	parquetWriterOpts.SortRows = s3Config.SortSpans
+
+	spanRecordSchema, err := newSpanRecordSchema(s3Config.PromotedTags)
+	if err != nil {
+		return nil, err
+	}
+
+	// Archived files are spilled into their own directory, so they are only replayed once
+	archiveS3Config := s3Config
+	if s3Config.SpillDirectory != "" {
+		archiveS3Config.SpillDirectory = filepath.Join(s3Config.SpillDirectory, "archive")
+	}
+
+	sink, err := NewParquetFileSink(logger, metricsFactory, svc, archiveS3Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create parquet file sink: %w", err)
+	}
+
+	if spillSink, ok := sink.(*SpillParquetFileSink); ok {
+		if err := spillSink.Replay(); err != nil {
+			return nil, fmt.Errorf("failed to replay spilled parquet files: %w", err)
+		}
+	}
+
+	spanParquetWriter, err := NewParquetWriter(ctx, logger, parquetWriterMetricsFactory(metricsFactory, "spans"), sink, s3Config.ArchiveSpansPrefix, spanRecordSchema, parquetWriterOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create parquet writer: %w", err)
+	}
+
+	return &ArchiveWriter{
+		logger:            logger,
+		metrics:           newWriterMetrics(metricsFactory),
+		sink:              sink,
+		spanParquetWriter: spanParquetWriter,
+		tagFilter:         NewTagFilter(s3Config),
+	}, nil
+}
+
+func (w *ArchiveWriter) WriteSpan(ctx context.Context, span *model.Span) error {
+	spanRecord, err := NewSpanRecordFromSpan(span, w.tagFilter)
+	if err != nil {
+		return fmt.Errorf("failed to create span record: %w", err)
+	}
+
+	if err := w.spanParquetWriter.Write(ctx, span.StartTime, span.StartTime, spanRecord); err != nil {
+		w.metrics.SpansFailed.Inc(1)
+		return fmt.Errorf("failed to write span item: %w", err)
+	}
+	w.metrics.SpansWritten.Inc(1)
+
+	return nil
+}
+
+// FlushStats counts archived spans written into parquet files
+func (w *ArchiveWriter) FlushStats() FlushStats {
+	return w.spanParquetWriter.FlushStats()
+}
+
+func (w *ArchiveWriter) Close() error {
+	if err := w.spanParquetWriter.Close(); err != nil {
+		return fmt.Errorf("failed to close parquet writer: %w", err)
+	}
+
+	if err := w.sink.Close(); err != nil {
+		return fmt.Errorf("failed to close parquet file sink: %w", err)
+	}
+
+	return nil
+}
+
+// NewArchiveReader creates a reader querying the archive spans table. Archived traces are
+// usually older than regular spans, so the archive uses its own max span age.
+func NewArchiveReader(ctx context.Context, logger hclog.Logger, metricsFactory metrics.Factory, svc AthenaAPI, cfg config.Athena, partitions PartitionScheme, promotedTags []string) (*Reader, error) {
+	return NewReader(ctx, logger, metricsFactory, svc, archiveAthenaConfig(cfg), partitions.WithoutServiceName(), promotedTags)
+}
+
+func NewArchiveReaderWithQueryEngine(ctx context.Context, logger hclog.Logger, engine QueryEngine, cfg config.Athena, partitions PartitionScheme, promotedTags []string) (*Reader, error) {
+	return NewReaderWithQueryEngine(ctx, logger, engine, archiveAthenaConfig(cfg), partitions.WithoutServiceName(), promotedTags)
+}
+
+func archiveAthenaConfig(cfg config.Athena) config.Athena {
+	archiveCfg := cfg
+	archiveCfg.SpansTableName = cfg.ArchiveSpansTableName
+	archiveCfg.MaxSpanAge = cfg.ArchiveMaxSpanAge
+	if archiveCfg.MaxSpanAge == "" {
+		archiveCfg.MaxSpanAge = defaultArchiveMaxSpanAge.String()
+	}
+	archiveCfg.DependenciesPrefetch = false
+
+	return archiveCfg
+}
@@ -0,0 +1,143 @@
+package s3spanstore
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/hashicorp/go-hclog"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-lib/metrics"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func NewTestArchiveWriter(ctx context.Context, assert *assert.Assertions, mockSvc *mocks.MockS3API) *ArchiveWriter {
+	loggerName := "jaeger-s3"
+
+	logLevel := os.Getenv("GRPC_STORAGE_PLUGIN_LOG_LEVEL")
+	if logLevel == "" {
+		logLevel = hclog.Debug.String()
+	}
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Level:      hclog.LevelFromString(logLevel),
+		Name:       loggerName,
+		JSONFormat: true,
+	})
+
+	writer, err := NewArchiveWriter(ctx, logger, metrics.NullFactory, mockSvc, config.S3{
+		BucketName:         "jaeger-spans",
+		SpansPrefix:        "/spans/",
+		OperationsPrefix:   "/operations/",
+		ArchiveSpansPrefix: "/spans-archive/",
+	}, PartitionScheme{})
+
+	assert.NoError(err)
+
+	return writer
+}
+
+func NewTestArchiveReader(ctx context.Context, assert *assert.Assertions, mockSvc *mocks.MockAthenaAPI) *Reader {
+	loggerName := "jaeger-s3"
+
+	logLevel := os.Getenv("GRPC_STORAGE_PLUGIN_LOG_LEVEL")
+	if logLevel == "" {
+		logLevel = hclog.Debug.String()
+	}
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Level:      hclog.LevelFromString(logLevel),
+		Name:       loggerName,
+		JSONFormat: true,
+	})
+
+	reader, err := NewArchiveReader(ctx, logger, metrics.NullFactory, mockSvc, config.Athena{
+		DatabaseName:          "default",
+		SpansTableName:        "jaeger_spans",
+		OperationsTableName:   "jaeger_operations",
+		OutputLocation:        "s3://jaeger-s3-test-results/",
+		WorkGroup:             "jaeger",
+		MaxSpanAge:            "336h",
+		DependenciesPrefetch:  true,
+		ArchiveSpansTableName: "jaeger_spans_archive",
+	}, PartitionScheme{}, nil)
+
+	assert.NoError(err)
+
+	return reader
+}
+
+func TestArchiveWriteSpan(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	putTest := NewS3PutTest()
+	defer putTest.Clean()
+
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		localTestObjects(putTest, assert)).Times(1)
+
+	writer := NewTestArchiveWriter(ctx, assert, mockSvc)
+
+	span := NewTestSpan(assert)
+
+	assert.NoError(writer.WriteSpan(ctx, span))
+	assert.NoError(writer.Close())
+
+	assert.Empty(putTest.FileWithPrefix("/spans/"))
+	assert.Empty(putTest.OperationsFile())
+
+	archiveFile := putTest.FileWithPrefix("/spans-archive/")
+	assert.NotEmpty(archiveFile)
+
+	localFileReader, err := local.NewLocalFileReader(archiveFile)
+	assert.NoError(err)
+	pr, err := reader.NewParquetReader(localFileReader, new(SpanRecord), 1)
+	assert.NoError(err)
+
+	assert.Equal(1, int(pr.GetNumRows()))
+
+	records := make([]SpanRecord, 1)
+	assert.NoError(pr.Read(&records))
+	assert.Equal("0000000000000011", records[0].TraceID)
+
+	pr.ReadStop()
+	assert.NoError(localFileReader.Close())
+}
+
+func TestArchiveGetTrace(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	span := NewTestSpan(assert)
+	spanRecord, err := NewSpanRecordFromSpan(span, nil)
+	assert.NoError(err)
+
+	mockSvc := mocks.NewMockAthenaAPI(ctrl)
+
+	var queryString string
+	mockQueryRunAndCapture(mockSvc, [][]string{{"2", toAthenaVarbinary(spanRecord.SpanPayload)}}, &queryString)
+
+	archiveReader := NewTestArchiveReader(ctx, assert, mockSvc)
+	defer archiveReader.Close()
+
+	trace, err := archiveReader.GetTrace(ctx, span.TraceID)
+	assert.NoError(err)
+	assert.Len(trace.Spans, 1)
+	assert.Equal(span.SpanID, trace.Spans[0].SpanID)
+
+	assert.Contains(queryString, `FROM "jaeger_spans_archive"`)
+	assert.Equal(defaultArchiveMaxSpanAge, archiveReader.maxSpanAge)
+}
@@ -0,0 +1,95 @@
+package s3spanstore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/athena/types"
+)
+
+// Athena error categories https://docs.aws.amazon.com/athena/latest/ug/error-reference.html
+const (
+	AthenaErrorCategorySystem = 1
+	AthenaErrorCategoryUser   = 2
+	AthenaErrorCategoryOther  = 3
+)
+
+// State change reasons of failures, which are worth retrying
+var athenaTransientStateChangeReasons = []string{
+	"TOO_MANY_REQUESTS",
+	"ThrottlingException",
+	"SlowDown",
+	"INTERNAL_ERROR",
+}
+
+// AthenaQueryError is returned for query executions, which finished without succeeding
+type AthenaQueryError struct {
+	QueryExecutionId  string
+	State             types.QueryExecutionState
+	StateChangeReason string
+	ErrorCategory     int32
+	ErrorType         int32
+	Retryable         bool
+}
+
+func NewAthenaQueryError(queryExecution *types.QueryExecution) *AthenaQueryError {
+	err := &AthenaQueryError{
+		QueryExecutionId: aws.ToString(queryExecution.QueryExecutionId),
+	}
+
+	if status := queryExecution.Status; status != nil {
+		err.State = status.State
+		err.StateChangeReason = aws.ToString(status.StateChangeReason)
+
+		if athenaError := status.AthenaError; athenaError != nil {
+			err.ErrorCategory = aws.ToInt32(athenaError.ErrorCategory)
+			err.ErrorType = aws.ToInt32(athenaError.ErrorType)
+			err.Retryable = athenaError.Retryable
+		}
+	}
+
+	return err
+}
+
+func (e *AthenaQueryError) Error() string {
+	return fmt.Sprintf("athena query execution %s %s (category %d, type %d): %s", e.QueryExecutionId, e.State, e.ErrorCategory, e.ErrorType, e.StateChangeReason)
+}
+
+// Transient returns whether the query failed due to a temporary issue within Athena
+// and is expected to succeed when retried. Cancelled queries are never retried.
+func (e *AthenaQueryError) Transient() bool {
+	if e.State != types.QueryExecutionStateFailed {
+		return false
+	}
+
+	if e.Retryable || e.ErrorCategory == AthenaErrorCategorySystem {
+		return true
+	}
+
+	for _, reason := range athenaTransientStateChangeReasons {
+		if strings.Contains(e.StateChangeReason, reason) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isTransientAthenaError returns whether err is caused by a failed query execution or an Athena
+// API error, which is expected to succeed when retried
+func isTransientAthenaError(err error) bool {
+	var queryErr *AthenaQueryError
+	if errors.As(err, &queryErr) {
+		return queryErr.Transient()
+	}
+
+	var tooManyRequestsErr *types.TooManyRequestsException
+	if errors.As(err, &tooManyRequestsErr) {
+		return true
+	}
+
+	var internalServerErr *types.InternalServerException
+	return errors.As(err, &internalServerErr)
+}
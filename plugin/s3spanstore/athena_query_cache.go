@@ -11,17 +11,19 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/athena"
 	"github.com/aws/aws-sdk-go-v2/service/athena/types"
 	"github.com/hashicorp/go-hclog"
+	"github.com/uber/jaeger-lib/metrics"
 	"golang.org/x/sync/errgroup"
 )
 
 type AthenaQueryCache struct {
 	logger    hclog.Logger
+	metrics   *AthenaQueryCacheMetrics
 	svc       AthenaAPI
 	workGroup string
 }
 
-func NewAthenaQueryCache(logger hclog.Logger, svc AthenaAPI, workGroup string) *AthenaQueryCache {
-	return &AthenaQueryCache{logger: logger, svc: svc, workGroup: workGroup}
+func NewAthenaQueryCache(logger hclog.Logger, metricsFactory metrics.Factory, svc AthenaAPI, workGroup string) *AthenaQueryCache {
+	return &AthenaQueryCache{logger: logger, metrics: newAthenaQueryCacheMetrics(metricsFactory), svc: svc, workGroup: workGroup}
 }
 
 func (c *AthenaQueryCache) Lookup(ctx context.Context, key string, ttl time.Duration) (*types.QueryExecution, error) {
@@ -92,6 +94,10 @@ func (c *AthenaQueryCache) Lookup(ctx context.Context, key string, ttl time.Dura
 
 			executionsFetched += len(result.QueryExecutions)
 			for _, v := range result.QueryExecutions {
+				if v.Status == nil || v.Status.SubmissionDateTime == nil || v.Query == nil {
+					continue
+				}
+
 				// Query already expired
 				if v.Status.SubmissionDateTime.Before(ttlTime) {
 					fetchCancelFunc() // Cancel search as results are ordered so no more recent query wll follow
@@ -122,5 +128,11 @@ func (c *AthenaQueryCache) Lookup(ctx context.Context, key string, ttl time.Dura
 		return nil, err
 	}
 
+	if latestQueryExecution != nil {
+		c.metrics.Hits.Inc(1)
+	} else {
+		c.metrics.Misses.Inc(1)
+	}
+
 	return latestQueryExecution, nil
 }
@@ -13,6 +13,7 @@ import (
 	"github.com/hashicorp/go-hclog"
 	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore/mocks"
 	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-lib/metrics"
 )
 
 func NewTestAthenaQueryCache(mockSvc *mocks.MockAthenaAPI) *AthenaQueryCache {
@@ -29,7 +30,7 @@ func NewTestAthenaQueryCache(mockSvc *mocks.MockAthenaAPI) *AthenaQueryCache {
 		JSONFormat: true,
 	})
 
-	return NewAthenaQueryCache(logger, mockSvc, "jaeger")
+	return NewAthenaQueryCache(logger, metrics.NullFactory, mockSvc, "jaeger")
 }
 
 func TestNoResults(t *testing.T) {
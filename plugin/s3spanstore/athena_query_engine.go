@@ -0,0 +1,471 @@
+package s3spanstore
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/athena"
+	"github.com/aws/aws-sdk-go-v2/service/athena/types"
+	"github.com/hashicorp/go-hclog"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/opentracing/opentracing-go"
+	"github.com/uber/jaeger-lib/metrics"
+)
+
+// mockgen -destination=./plugin/s3spanstore/mocks/mock_athena.go -package=mocks github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore AthenaAPI
+
+type AthenaAPI interface {
+	BatchGetQueryExecution(ctx context.Context, params *athena.BatchGetQueryExecutionInput, optFns ...func(*athena.Options)) (*athena.BatchGetQueryExecutionOutput, error)
+	GetQueryExecution(ctx context.Context, params *athena.GetQueryExecutionInput, optFns ...func(*athena.Options)) (*athena.GetQueryExecutionOutput, error)
+	GetQueryResults(ctx context.Context, params *athena.GetQueryResultsInput, optFns ...func(*athena.Options)) (*athena.GetQueryResultsOutput, error)
+	ListQueryExecutions(ctx context.Context, params *athena.ListQueryExecutionsInput, optFns ...func(*athena.Options)) (*athena.ListQueryExecutionsOutput, error)
+	StartQueryExecution(ctx context.Context, params *athena.StartQueryExecutionInput, optFns ...func(*athena.Options)) (*athena.StartQueryExecutionOutput, error)
+	StopQueryExecution(ctx context.Context, params *athena.StopQueryExecutionInput, optFns ...func(*athena.Options)) (*athena.StopQueryExecutionOutput, error)
+}
+
+const (
+	// Athena bills the data scanned rounded up to the next megabyte with a minimum of 10 megabytes per query
+	athenaBillingIncrementBytes = 1 << 20
+	athenaMinimumBilledBytes    = 10 * athenaBillingIncrementBytes
+	athenaTerabyte              = 1 << 40
+
+	// Query executions are polled with an exponential backoff
+	athenaPollInitialInterval = 100 * time.Millisecond
+	athenaPollMaxInterval     = 2 * time.Second
+	athenaPollMultiplier      = 2
+
+	// Timeout to stop abandoned query executions, independent of the already cancelled request context
+	athenaStopQueryTimeout = 5 * time.Second
+
+	// Queries failing due to transient errors are retried with an exponential backoff
+	athenaRetryInitialBackoff = 500 * time.Millisecond
+)
+
+var (
+	defaultAthenaPricePerTerabyte = 5.0
+	defaultAthenaMaxQueryRetries  = 2
+)
+
+type AthenaQueryEngine struct {
+	logger           hclog.Logger
+	metricsFactory   metrics.Factory
+	svc              AthenaAPI
+	cfg              config.Athena
+	athenaQueryCache *AthenaQueryCache
+	pricePerTerabyte float64
+	maxQueryRetries  int
+	retryBackoff     time.Duration
+
+	kindMetrics           map[QueryKind]*AthenaMetrics
+	kindStatisticsMetrics map[athenaStatisticsMetricsKey]*AthenaStatisticsMetrics
+	kindMetricsMutex      sync.Mutex
+}
+
+type athenaStatisticsMetricsKey struct {
+	kind  QueryKind
+	state types.QueryExecutionState
+}
+
+func NewAthenaQueryEngine(logger hclog.Logger, metricsFactory metrics.Factory, svc AthenaAPI, cfg config.Athena) *AthenaQueryEngine {
+	pricePerTerabyte := defaultAthenaPricePerTerabyte
+	if cfg.PricePerTerabyte > 0 {
+		pricePerTerabyte = cfg.PricePerTerabyte
+	}
+
+	// Negative values disable retries
+	maxQueryRetries := defaultAthenaMaxQueryRetries
+	if cfg.MaxQueryRetries < 0 {
+		maxQueryRetries = 0
+	} else if cfg.MaxQueryRetries > 0 {
+		maxQueryRetries = cfg.MaxQueryRetries
+	}
+
+	return &AthenaQueryEngine{
+		logger:           logger,
+		metricsFactory:   metricsFactory,
+		svc:              svc,
+		cfg:              cfg,
+		athenaQueryCache: NewAthenaQueryCache(logger, metricsFactory, svc, cfg.WorkGroup),
+		pricePerTerabyte: pricePerTerabyte,
+		maxQueryRetries:  maxQueryRetries,
+		retryBackoff:     athenaRetryInitialBackoff,
+		kindMetrics:      map[QueryKind]*AthenaMetrics{},
+
+		kindStatisticsMetrics: map[athenaStatisticsMetricsKey]*AthenaStatisticsMetrics{},
+	}
+}
+
+// metrics returns the metrics of queries of the given kind
+func (e *AthenaQueryEngine) metrics(kind QueryKind) *AthenaMetrics {
+	e.kindMetricsMutex.Lock()
+	defer e.kindMetricsMutex.Unlock()
+
+	m, ok := e.kindMetrics[kind]
+	if !ok {
+		m = newAthenaMetrics(e.metricsFactory.Namespace(metrics.NSOptions{Tags: map[string]string{"query_kind": string(kind)}}))
+		e.kindMetrics[kind] = m
+	}
+
+	return m
+}
+
+// statisticsMetrics returns the metrics of query executions of the given kind, which ended in the given state
+func (e *AthenaQueryEngine) statisticsMetrics(kind QueryKind, state types.QueryExecutionState) *AthenaStatisticsMetrics {
+	e.kindMetricsMutex.Lock()
+	defer e.kindMetricsMutex.Unlock()
+
+	key := athenaStatisticsMetricsKey{kind: kind, state: state}
+	m, ok := e.kindStatisticsMetrics[key]
+	if !ok {
+		m = newAthenaStatisticsMetrics(e.metricsFactory.Namespace(metrics.NSOptions{Tags: map[string]string{
+			"query_kind": string(kind),
+			"state":      string(state),
+		}}))
+		e.kindStatisticsMetrics[key] = m
+	}
+
+	return m
+}
+
+// Athena engine version 3 fails when accessing keys missing in a map using a subscript, so element_at is used instead
+func (e *AthenaQueryEngine) MapElement(column string, key string) string {
+	return fmt.Sprintf(`element_at(%s, %s)`, column, sqlString(key))
+}
+
+func (e *AthenaQueryEngine) AnyElement(column string, variable string, condition string) string {
+	return fmt.Sprintf(`cardinality(filter(%s, %s -> %s)) > 0`, column, variable, condition)
+}
+
+// Athena returns varbinary values as space separated hex encoded bytes
+func (e *AthenaQueryEngine) DecodeBinary(value string) ([]byte, error) {
+	return hex.DecodeString(strings.ReplaceAll(value, " ", ""))
+}
+
+func (e *AthenaQueryEngine) QueryCached(ctx context.Context, kind QueryKind, queryString string, lookupString string, ttl time.Duration) ([]QueryRow, error) {
+	otSpan, _ := opentracing.StartSpanFromContext(ctx, "queryAthenaCached")
+	defer otSpan.Finish()
+
+	queryExecution, err := e.athenaQueryCache.Lookup(ctx, lookupString, ttl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup cached athena query: %w", err)
+	}
+
+	if queryExecution != nil {
+		result, err := e.waitAndFetchQueryResult(ctx, queryExecution)
+
+		// The cached query execution failed after the lookup, so execute the query again
+		var queryErr *AthenaQueryError
+		if errors.As(err, &queryErr) {
+			e.logger.Debug("cached athena query execution failed", "queryKind", kind, "error", err)
+			return e.Query(ctx, kind, queryString)
+		}
+
+		return result, err
+	}
+
+	return e.Query(ctx, kind, queryString)
+}
+
+func (e *AthenaQueryEngine) Query(ctx context.Context, kind QueryKind, queryString string) ([]QueryRow, error) {
+	otSpan, _ := opentracing.StartSpanFromContext(ctx, "queryAthena")
+	defer otSpan.Finish()
+	otSpan.SetTag("query_kind", string(kind))
+
+	kindMetrics := e.metrics(kind)
+
+	start := time.Now()
+	result, err := e.queryWithRetries(ctx, otSpan, kind, kindMetrics, queryString)
+	kindMetrics.QueryDuration.Record(time.Since(start))
+	kindMetrics.Queries.Inc(1)
+
+	if err != nil {
+		kindMetrics.QueryErrors.Inc(1)
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// queryWithRetries executes the query and retries it when failing due to a transient error,
+// as long as the retry budget of the query isn't exhausted.
+func (e *AthenaQueryEngine) queryWithRetries(ctx context.Context, otSpan opentracing.Span, kind QueryKind, kindMetrics *AthenaMetrics, queryString string) ([]QueryRow, error) {
+	retryBackoff := e.retryBackoff
+	for attempt := 0; ; attempt++ {
+		result, queryExecution, err := e.query(ctx, queryString)
+
+		// Failed queries are billed for the data scanned as well
+		if queryExecution != nil {
+			e.recordQueryStatistics(otSpan, kind, queryExecution)
+		}
+
+		if err == nil || attempt >= e.maxQueryRetries || !isTransientAthenaError(err) {
+			return result, err
+		}
+
+		kindMetrics.QueryRetries.Inc(1)
+		e.logger.Warn("retrying athena query after transient failure", "queryKind", kind, "attempt", attempt+1, "error", err)
+
+		timer := time.NewTimer(retryBackoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("failed to retry athena query: %w", ctx.Err())
+		case <-timer.C:
+		}
+		retryBackoff *= 2
+	}
+}
+
+// recordQueryStatistics logs and records the data scanned, engine execution time and estimated
+// cost of a query execution by its final state, so costs can be attributed to the Reader operations
+// causing them.
+func (e *AthenaQueryEngine) recordQueryStatistics(otSpan opentracing.Span, kind QueryKind, queryExecution *types.QueryExecution) {
+	statistics := queryExecution.Statistics
+	if statistics == nil {
+		return
+	}
+
+	var state types.QueryExecutionState
+	var stateChangeReason string
+	if status := queryExecution.Status; status != nil {
+		state = status.State
+		stateChangeReason = aws.ToString(status.StateChangeReason)
+	}
+
+	var dataScannedBytes int64
+	if statistics.DataScannedInBytes != nil {
+		dataScannedBytes = *statistics.DataScannedInBytes
+	}
+
+	var engineExecutionTime time.Duration
+	if statistics.EngineExecutionTimeInMillis != nil {
+		engineExecutionTime = time.Duration(*statistics.EngineExecutionTimeInMillis) * time.Millisecond
+	}
+
+	estimatedCost := estimateAthenaQueryCost(dataScannedBytes, e.pricePerTerabyte)
+
+	statisticsMetrics := e.statisticsMetrics(kind, state)
+	statisticsMetrics.DataScannedBytes.Inc(dataScannedBytes)
+	statisticsMetrics.EngineExecutionTime.Record(engineExecutionTime)
+
+	otSpan.SetTag("athena.query_execution_id", aws.ToString(queryExecution.QueryExecutionId))
+	otSpan.SetTag("athena.state", string(state))
+	otSpan.SetTag("athena.data_scanned_bytes", dataScannedBytes)
+	otSpan.SetTag("athena.engine_execution_time_ms", engineExecutionTime.Milliseconds())
+	otSpan.SetTag("athena.estimated_cost", estimatedCost)
+
+	if state == types.QueryExecutionStateSucceeded {
+		e.logger.Info("athena query completed",
+			"queryKind", kind,
+			"queryExecutionId", aws.ToString(queryExecution.QueryExecutionId),
+			"state", state,
+			"dataScannedBytes", dataScannedBytes,
+			"engineExecutionTime", engineExecutionTime,
+			"estimatedCost", estimatedCost,
+		)
+		return
+	}
+
+	e.logger.Warn("athena query did not succeed",
+		"queryKind", kind,
+		"queryExecutionId", aws.ToString(queryExecution.QueryExecutionId),
+		"state", state,
+		"stateChangeReason", stateChangeReason,
+		"dataScannedBytes", dataScannedBytes,
+		"engineExecutionTime", engineExecutionTime,
+		"estimatedCost", estimatedCost,
+	)
+}
+
+// estimateAthenaQueryCost returns the estimated cost of a query in the currency of pricePerTerabyte
+func estimateAthenaQueryCost(dataScannedBytes int64, pricePerTerabyte float64) float64 {
+	billedBytes := (dataScannedBytes + athenaBillingIncrementBytes - 1) / athenaBillingIncrementBytes * athenaBillingIncrementBytes
+	if billedBytes < athenaMinimumBilledBytes {
+		billedBytes = athenaMinimumBilledBytes
+	}
+
+	return float64(billedBytes) / athenaTerabyte * pricePerTerabyte
+}
+
+func (e *AthenaQueryEngine) query(ctx context.Context, queryString string) ([]QueryRow, *types.QueryExecution, error) {
+	output, err := e.svc.StartQueryExecution(ctx, &athena.StartQueryExecutionInput{
+		QueryString: &queryString,
+		QueryExecutionContext: &types.QueryExecutionContext{
+			Database: &e.cfg.DatabaseName,
+		},
+		ResultConfiguration: &types.ResultConfiguration{
+			OutputLocation: &e.cfg.OutputLocation,
+		},
+		WorkGroup: &e.cfg.WorkGroup,
+	})
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start athena query: %w", err)
+	}
+
+	status, err := e.svc.GetQueryExecution(ctx, &athena.GetQueryExecutionInput{
+		QueryExecutionId: output.QueryExecutionId,
+	})
+	if err != nil {
+		e.stopAbandonedQueryExecution(ctx, output.QueryExecutionId)
+		return nil, nil, fmt.Errorf("failed to get athena query execution: %w", err)
+	}
+
+	queryExecution := status.QueryExecution
+	if queryExecution == nil {
+		queryExecution = &types.QueryExecution{QueryExecutionId: output.QueryExecutionId}
+	}
+
+	queryExecution, err = e.waitForQueryExecution(ctx, queryExecution)
+	if err != nil {
+		e.stopAbandonedQueryExecution(ctx, output.QueryExecutionId)
+		return nil, queryExecution, err
+	}
+
+	result, err := e.fetchQueryResult(ctx, queryExecution.QueryExecutionId)
+	return result, queryExecution, err
+}
+
+func (e *AthenaQueryEngine) waitAndFetchQueryResult(ctx context.Context, queryExecution *types.QueryExecution) ([]QueryRow, error) {
+	otSpan, _ := opentracing.StartSpanFromContext(ctx, "waitAndFetchQueryResult")
+	defer otSpan.Finish()
+
+	queryExecution, err := e.waitForQueryExecution(ctx, queryExecution)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.fetchQueryResult(ctx, queryExecution.QueryExecutionId)
+}
+
+// waitForQueryExecution polls until the query completed and returns the final query execution.
+// Polling stops once ctx is cancelled or its deadline exceeded. Query executions, which finished
+// without succeeding, are returned together with an AthenaQueryError.
+func (e *AthenaQueryEngine) waitForQueryExecution(ctx context.Context, queryExecution *types.QueryExecution) (*types.QueryExecution, error) {
+	otSpan, _ := opentracing.StartSpanFromContext(ctx, "waitForQueryExecution")
+	defer otSpan.Finish()
+
+	pollInterval := athenaPollInitialInterval
+	for {
+		if isAthenaQueryExecutionCompleted(queryExecution) {
+			break
+		}
+
+		timer := time.NewTimer(pollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("failed to wait for athena query execution: %w", ctx.Err())
+		case <-timer.C:
+		}
+		pollInterval = nextAthenaPollInterval(pollInterval)
+
+		status, err := e.svc.GetQueryExecution(ctx, &athena.GetQueryExecutionInput{
+			QueryExecutionId: queryExecution.QueryExecutionId,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get athena query execution: %w", err)
+		}
+
+		if status.QueryExecution != nil {
+			queryExecution = status.QueryExecution
+		}
+	}
+
+	if state := queryExecution.Status.State; state == types.QueryExecutionStateFailed || state == types.QueryExecutionStateCancelled {
+		return queryExecution, NewAthenaQueryError(queryExecution)
+	}
+
+	return queryExecution, nil
+}
+
+// isAthenaQueryExecutionCompleted reports whether the query execution finished, query executions
+// without status aren't completed yet
+func isAthenaQueryExecutionCompleted(queryExecution *types.QueryExecution) bool {
+	if queryExecution == nil || queryExecution.Status == nil {
+		return false
+	}
+
+	switch queryExecution.Status.State {
+	case types.QueryExecutionStateSucceeded, types.QueryExecutionStateFailed, types.QueryExecutionStateCancelled:
+		return true
+	}
+
+	return queryExecution.Status.CompletionDateTime != nil
+}
+
+func nextAthenaPollInterval(pollInterval time.Duration) time.Duration {
+	pollInterval *= athenaPollMultiplier
+	if pollInterval > athenaPollMaxInterval {
+		return athenaPollMaxInterval
+	}
+
+	return pollInterval
+}
+
+// stopAbandonedQueryExecution stops the query execution when ctx was cancelled or its deadline exceeded,
+// so queries abandoned by the client don't continue to scan (and cost) in the background. Cached query
+// executions are never stopped, as they might have been started and still be awaited by another request.
+func (e *AthenaQueryEngine) stopAbandonedQueryExecution(ctx context.Context, queryExecutionId *string) {
+	if ctx.Err() == nil {
+		return
+	}
+
+	stopCtx, cancel := context.WithTimeout(context.Background(), athenaStopQueryTimeout)
+	defer cancel()
+
+	if _, err := e.svc.StopQueryExecution(stopCtx, &athena.StopQueryExecutionInput{
+		QueryExecutionId: queryExecutionId,
+	}); err != nil {
+		e.logger.Warn("failed to stop abandoned athena query execution", "queryExecutionId", aws.ToString(queryExecutionId), "error", err)
+		return
+	}
+
+	e.logger.Debug("stopped abandoned athena query execution", "queryExecutionId", aws.ToString(queryExecutionId))
+}
+
+func (e *AthenaQueryEngine) fetchQueryResult(ctx context.Context, queryExecutionId *string) ([]QueryRow, error) {
+	otSpan, _ := opentracing.StartSpanFromContext(ctx, "fetchQueryResult")
+	defer otSpan.Finish()
+
+	// Get query results
+	paginator := athena.NewGetQueryResultsPaginator(e.svc, &athena.GetQueryResultsInput{
+		QueryExecutionId: queryExecutionId,
+	})
+	rows := []types.Row{}
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get athena query result: %w", err)
+		}
+
+		rows = append(rows, output.ResultSet.Rows...)
+	}
+
+	// Remove the table header
+	if len(rows) >= 1 {
+		rows = rows[1:]
+	}
+
+	result := make([]QueryRow, len(rows))
+	for i, row := range rows {
+		result[i] = make(QueryRow, len(row.Data))
+		for j, datum := range row.Data {
+			if datum.VarCharValue != nil {
+				result[i][j] = *datum.VarCharValue
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func (e *AthenaQueryEngine) Close() error {
+	return nil
+}
@@ -0,0 +1,454 @@
+package s3spanstore
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/athena"
+	"github.com/aws/aws-sdk-go-v2/service/athena/types"
+	"github.com/golang/mock/gomock"
+	"github.com/hashicorp/go-hclog"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-lib/metrics"
+	"github.com/uber/jaeger-lib/metrics/metricstest"
+)
+
+func NewTestAthenaQueryEngine(mockSvc *mocks.MockAthenaAPI, metricsFactory metrics.Factory) *AthenaQueryEngine {
+	loggerName := "jaeger-s3"
+
+	logLevel := os.Getenv("GRPC_STORAGE_PLUGIN_LOG_LEVEL")
+	if logLevel == "" {
+		logLevel = hclog.Debug.String()
+	}
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Level:      hclog.LevelFromString(logLevel),
+		Name:       loggerName,
+		JSONFormat: true,
+	})
+
+	return NewAthenaQueryEngine(logger, metricsFactory, mockSvc, config.Athena{
+		DatabaseName:   "default",
+		OutputLocation: "s3://jaeger-s3-test-results/",
+		WorkGroup:      "jaeger",
+	})
+}
+
+func TestAthenaQueryEngineMetrics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	now := time.Now()
+
+	mockSvc := mocks.NewMockAthenaAPI(ctrl)
+	mockSvc.EXPECT().StartQueryExecution(gomock.Any(), gomock.Any()).
+		Return(&athena.StartQueryExecutionOutput{QueryExecutionId: aws.String("queryId")}, nil)
+	mockSvc.EXPECT().GetQueryExecution(gomock.Any(), gomock.Any()).
+		Return(&athena.GetQueryExecutionOutput{
+			QueryExecution: &types.QueryExecution{
+				QueryExecutionId: aws.String("queryId"),
+				Status: &types.QueryExecutionStatus{
+					State:              types.QueryExecutionStateSucceeded,
+					CompletionDateTime: &now,
+				},
+				Statistics: &types.QueryExecutionStatistics{
+					DataScannedInBytes:          aws.Int64(1024),
+					EngineExecutionTimeInMillis: aws.Int64(1500),
+				},
+			},
+		}, nil)
+	mockSvc.EXPECT().GetQueryResults(gomock.Any(), gomock.Any()).
+		Return(&athena.GetQueryResultsOutput{
+			ResultSet: toAthenaResultSet([][]string{{"test"}}),
+		}, nil)
+	mockSvc.EXPECT().ListQueryExecutions(gomock.Any(), gomock.Any()).
+		Return(&athena.ListQueryExecutionsOutput{}, nil)
+
+	metricsFactory := metricstest.NewFactory(0)
+	defer metricsFactory.Stop()
+
+	engine := NewTestAthenaQueryEngine(mockSvc, metricsFactory)
+
+	rows, err := engine.QueryCached(ctx, QueryKindGetServices, "SELECT service_name FROM jaeger_operations", "jaeger_operations", time.Minute)
+	assert.NoError(err)
+	assert.Equal([]QueryRow{{"test"}}, rows)
+
+	tags := map[string]string{"query_kind": "GetServices"}
+	metricsFactory.AssertCounterMetrics(t,
+		metricstest.ExpectedMetric{Name: "athena_queries", Tags: tags, Value: 1},
+		metricstest.ExpectedMetric{Name: "athena_query_errors", Tags: tags, Value: 0},
+		metricstest.ExpectedMetric{Name: "athena_data_scanned_bytes", Tags: map[string]string{"query_kind": "GetServices", "state": "SUCCEEDED"}, Value: 1024},
+		metricstest.ExpectedMetric{Name: "athena_query_cache_hits", Value: 0},
+		metricstest.ExpectedMetric{Name: "athena_query_cache_misses", Value: 1},
+	)
+}
+
+func TestEstimateAthenaQueryCost(t *testing.T) {
+	assert := assert.New(t)
+
+	// Queries are billed with a minimum of 10MB
+	assert.InDelta(10.0/(1<<20)*5, estimateAthenaQueryCost(0, 5), 1e-12)
+	assert.InDelta(10.0/(1<<20)*5, estimateAthenaQueryCost(1024, 5), 1e-12)
+
+	// and rounded up to the next megabyte
+	assert.InDelta(11.0/(1<<20)*5, estimateAthenaQueryCost(10*(1<<20)+1, 5), 1e-12)
+	assert.InDelta(5.0, estimateAthenaQueryCost(1<<40, 5), 1e-12)
+}
+
+func runningQueryExecution(queryID string) *athena.GetQueryExecutionOutput {
+	return &athena.GetQueryExecutionOutput{
+		QueryExecution: &types.QueryExecution{
+			QueryExecutionId: aws.String(queryID),
+			Status: &types.QueryExecutionStatus{
+				State: types.QueryExecutionStateRunning,
+			},
+		},
+	}
+}
+
+func TestAthenaQueryEngineStopsCancelledQuery(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mockSvc := mocks.NewMockAthenaAPI(ctrl)
+	mockSvc.EXPECT().StartQueryExecution(gomock.Any(), gomock.Any()).
+		Return(&athena.StartQueryExecutionOutput{QueryExecutionId: aws.String("queryId")}, nil)
+	mockSvc.EXPECT().GetQueryExecution(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, _ *athena.GetQueryExecutionInput, _ ...func(*athena.Options)) (*athena.GetQueryExecutionOutput, error) {
+			cancel()
+			return runningQueryExecution("queryId"), nil
+		})
+	mockSvc.EXPECT().StopQueryExecution(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, input *athena.StopQueryExecutionInput, _ ...func(*athena.Options)) (*athena.StopQueryExecutionOutput, error) {
+			assert.NoError(ctx.Err())
+			assert.Equal("queryId", *input.QueryExecutionId)
+
+			return &athena.StopQueryExecutionOutput{}, nil
+		})
+
+	engine := NewTestAthenaQueryEngine(mockSvc, metrics.NullFactory)
+
+	_, err := engine.Query(ctx, QueryKindFindTraces, "SELECT trace_id FROM jaeger_spans")
+	assert.ErrorIs(err, context.Canceled)
+}
+
+func TestAthenaQueryEngineStopsQueryAfterDeadline(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+
+	mockSvc := mocks.NewMockAthenaAPI(ctrl)
+	mockSvc.EXPECT().StartQueryExecution(gomock.Any(), gomock.Any()).
+		Return(&athena.StartQueryExecutionOutput{QueryExecutionId: aws.String("queryId")}, nil)
+	mockSvc.EXPECT().GetQueryExecution(gomock.Any(), gomock.Any()).
+		Return(runningQueryExecution("queryId"), nil).
+		MinTimes(2)
+	mockSvc.EXPECT().StopQueryExecution(gomock.Any(), gomock.Any()).
+		Return(&athena.StopQueryExecutionOutput{}, nil)
+
+	engine := NewTestAthenaQueryEngine(mockSvc, metrics.NullFactory)
+
+	_, err := engine.Query(ctx, QueryKindFindTraces, "SELECT trace_id FROM jaeger_spans")
+	assert.ErrorIs(err, context.DeadlineExceeded)
+}
+
+func TestAthenaQueryEngineDoesNotStopCachedQuery(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	submissionDateTime := time.Now()
+
+	mockSvc := mocks.NewMockAthenaAPI(ctrl)
+	mockSvc.EXPECT().ListQueryExecutions(gomock.Any(), gomock.Any()).
+		Return(&athena.ListQueryExecutionsOutput{QueryExecutionIds: []string{"queryId"}}, nil)
+	mockSvc.EXPECT().BatchGetQueryExecution(gomock.Any(), gomock.Any()).
+		Return(&athena.BatchGetQueryExecutionOutput{
+			QueryExecutions: []types.QueryExecution{
+				{
+					Query:            aws.String("SELECT distinct service_name FROM jaeger_operations"),
+					QueryExecutionId: aws.String("queryId"),
+					Status: &types.QueryExecutionStatus{
+						State:              types.QueryExecutionStateRunning,
+						SubmissionDateTime: &submissionDateTime,
+					},
+				},
+			},
+		}, nil)
+	mockSvc.EXPECT().GetQueryExecution(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, _ *athena.GetQueryExecutionInput, _ ...func(*athena.Options)) (*athena.GetQueryExecutionOutput, error) {
+			cancel()
+			return runningQueryExecution("queryId"), nil
+		})
+
+	engine := NewTestAthenaQueryEngine(mockSvc, metrics.NullFactory)
+
+	_, err := engine.QueryCached(ctx, QueryKindGetServices, "SELECT distinct service_name FROM jaeger_operations", "SELECT distinct service_name", time.Minute)
+	assert.ErrorIs(err, context.Canceled)
+}
+
+func TestNextAthenaPollInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(200*time.Millisecond, nextAthenaPollInterval(athenaPollInitialInterval))
+	assert.Equal(1600*time.Millisecond, nextAthenaPollInterval(800*time.Millisecond))
+	assert.Equal(athenaPollMaxInterval, nextAthenaPollInterval(1600*time.Millisecond))
+	assert.Equal(athenaPollMaxInterval, nextAthenaPollInterval(athenaPollMaxInterval))
+}
+
+func completedQueryExecution(queryID string, state types.QueryExecutionState, athenaError *types.AthenaError, stateChangeReason string) *athena.GetQueryExecutionOutput {
+	return &athena.GetQueryExecutionOutput{
+		QueryExecution: &types.QueryExecution{
+			QueryExecutionId: aws.String(queryID),
+			Status: &types.QueryExecutionStatus{
+				State:             state,
+				AthenaError:       athenaError,
+				StateChangeReason: aws.String(stateChangeReason),
+			},
+			Statistics: &types.QueryExecutionStatistics{
+				DataScannedInBytes: aws.Int64(1024),
+			},
+		},
+	}
+}
+
+func mockQueryStart(mockSvc *mocks.MockAthenaAPI, queryID string) {
+	mockSvc.EXPECT().StartQueryExecution(gomock.Any(), gomock.Any()).
+		Return(&athena.StartQueryExecutionOutput{QueryExecutionId: aws.String(queryID)}, nil)
+}
+
+func mockQueryResult(mockSvc *mocks.MockAthenaAPI, result [][]string) {
+	mockSvc.EXPECT().GetQueryResults(gomock.Any(), gomock.Any()).
+		Return(&athena.GetQueryResultsOutput{
+			ResultSet: toAthenaResultSet(result),
+		}, nil)
+}
+
+func TestAthenaQueryEngineQueryStates(t *testing.T) {
+	userError := &types.AthenaError{ErrorCategory: aws.Int32(AthenaErrorCategoryUser), ErrorType: aws.Int32(1301)}
+	systemError := &types.AthenaError{ErrorCategory: aws.Int32(AthenaErrorCategorySystem), ErrorType: aws.Int32(401)}
+	throttlingError := &types.AthenaError{ErrorCategory: aws.Int32(AthenaErrorCategoryOther)}
+
+	tests := []struct {
+		name     string
+		states   []*athena.GetQueryExecutionOutput
+		expected []QueryRow
+		retries  int64
+		state    types.QueryExecutionState
+	}{
+		{
+			name:     "succeeded",
+			states:   []*athena.GetQueryExecutionOutput{completedQueryExecution("q1", types.QueryExecutionStateSucceeded, nil, "")},
+			expected: []QueryRow{{"test"}},
+		},
+		{
+			name:   "failed with user error",
+			states: []*athena.GetQueryExecutionOutput{completedQueryExecution("q1", types.QueryExecutionStateFailed, userError, "SYNTAX_ERROR: line 1:8: Column 'foo' cannot be resolved")},
+			state:  types.QueryExecutionStateFailed,
+		},
+		{
+			name:   "cancelled",
+			states: []*athena.GetQueryExecutionOutput{completedQueryExecution("q1", types.QueryExecutionStateCancelled, nil, "Query cancelled by user")},
+			state:  types.QueryExecutionStateCancelled,
+		},
+		{
+			name: "failed with system error and retried",
+			states: []*athena.GetQueryExecutionOutput{
+				completedQueryExecution("q1", types.QueryExecutionStateFailed, systemError, "INTERNAL_ERROR_QUERY_ENGINE"),
+				completedQueryExecution("q2", types.QueryExecutionStateSucceeded, nil, ""),
+			},
+			expected: []QueryRow{{"test"}},
+			retries:  1,
+		},
+		{
+			name: "failed with throttling and retried",
+			states: []*athena.GetQueryExecutionOutput{
+				completedQueryExecution("q1", types.QueryExecutionStateFailed, throttlingError, "TOO_MANY_REQUESTS: Rate exceeded"),
+				completedQueryExecution("q2", types.QueryExecutionStateSucceeded, nil, ""),
+			},
+			expected: []QueryRow{{"test"}},
+			retries:  1,
+		},
+		{
+			name: "failed with system error exhausting the retry budget",
+			states: []*athena.GetQueryExecutionOutput{
+				completedQueryExecution("q1", types.QueryExecutionStateFailed, systemError, "INTERNAL_ERROR_QUERY_ENGINE"),
+				completedQueryExecution("q2", types.QueryExecutionStateFailed, systemError, "INTERNAL_ERROR_QUERY_ENGINE"),
+				completedQueryExecution("q3", types.QueryExecutionStateFailed, systemError, "INTERNAL_ERROR_QUERY_ENGINE"),
+			},
+			retries: 2,
+			state:   types.QueryExecutionStateFailed,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			assert := assert.New(t)
+			ctx := context.TODO()
+
+			mockSvc := mocks.NewMockAthenaAPI(ctrl)
+			calls := []*gomock.Call{}
+			for _, state := range tt.states {
+				calls = append(calls,
+					mockSvc.EXPECT().StartQueryExecution(gomock.Any(), gomock.Any()).
+						Return(&athena.StartQueryExecutionOutput{QueryExecutionId: state.QueryExecution.QueryExecutionId}, nil),
+					mockSvc.EXPECT().GetQueryExecution(gomock.Any(), gomock.Any()).
+						Return(state, nil),
+				)
+			}
+			gomock.InOrder(calls...)
+			if tt.expected != nil {
+				mockQueryResult(mockSvc, [][]string{{"test"}})
+			}
+
+			metricsFactory := metricstest.NewFactory(0)
+			defer metricsFactory.Stop()
+
+			engine := NewTestAthenaQueryEngine(mockSvc, metricsFactory)
+			engine.retryBackoff = time.Millisecond
+
+			rows, err := engine.Query(ctx, QueryKindGetTrace, "SELECT span_payload FROM jaeger_spans")
+			if tt.expected != nil {
+				assert.NoError(err)
+				assert.Equal(tt.expected, rows)
+			} else {
+				var queryErr *AthenaQueryError
+				assert.ErrorAs(err, &queryErr)
+				assert.Equal(tt.state, queryErr.State)
+				assert.Equal(*tt.states[len(tt.states)-1].QueryExecution.Status.StateChangeReason, queryErr.StateChangeReason)
+			}
+
+			// Data scanned by failed and cancelled executions is recorded by their final state
+			expectedMetrics := []metricstest.ExpectedMetric{
+				{Name: "athena_query_retries", Tags: map[string]string{"query_kind": "GetTrace"}, Value: int(tt.retries)},
+			}
+			dataScannedBytes := map[types.QueryExecutionState]int{}
+			for _, state := range tt.states {
+				dataScannedBytes[state.QueryExecution.Status.State] += 1024
+			}
+			for state, value := range dataScannedBytes {
+				expectedMetrics = append(expectedMetrics, metricstest.ExpectedMetric{
+					Name:  "athena_data_scanned_bytes",
+					Tags:  map[string]string{"query_kind": "GetTrace", "state": string(state)},
+					Value: value,
+				})
+			}
+			metricsFactory.AssertCounterMetrics(t, expectedMetrics...)
+		})
+	}
+}
+
+func TestAthenaQueryEngineRetriesThrottledStart(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc := mocks.NewMockAthenaAPI(ctrl)
+	gomock.InOrder(
+		mockSvc.EXPECT().StartQueryExecution(gomock.Any(), gomock.Any()).
+			Return(nil, &types.TooManyRequestsException{Message: aws.String("Rate exceeded")}),
+		mockSvc.EXPECT().StartQueryExecution(gomock.Any(), gomock.Any()).
+			Return(&athena.StartQueryExecutionOutput{QueryExecutionId: aws.String("q1")}, nil),
+	)
+	mockSvc.EXPECT().GetQueryExecution(gomock.Any(), gomock.Any()).
+		Return(completedQueryExecution("q1", types.QueryExecutionStateSucceeded, nil, ""), nil)
+	mockQueryResult(mockSvc, [][]string{{"test"}})
+
+	engine := NewTestAthenaQueryEngine(mockSvc, metrics.NullFactory)
+	engine.retryBackoff = time.Millisecond
+
+	rows, err := engine.Query(ctx, QueryKindGetTrace, "SELECT span_payload FROM jaeger_spans")
+	assert.NoError(err)
+	assert.Equal([]QueryRow{{"test"}}, rows)
+}
+
+func TestAthenaQueryEngineQueryExecutionWithoutStatus(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc := mocks.NewMockAthenaAPI(ctrl)
+	mockQueryStart(mockSvc, "q1")
+	gomock.InOrder(
+		mockSvc.EXPECT().GetQueryExecution(gomock.Any(), gomock.Any()).
+			Return(&athena.GetQueryExecutionOutput{}, nil),
+		mockSvc.EXPECT().GetQueryExecution(gomock.Any(), gomock.Any()).
+			Return(&athena.GetQueryExecutionOutput{QueryExecution: &types.QueryExecution{QueryExecutionId: aws.String("q1")}}, nil),
+		mockSvc.EXPECT().GetQueryExecution(gomock.Any(), gomock.Any()).
+			Return(completedQueryExecution("q1", types.QueryExecutionStateSucceeded, nil, ""), nil),
+	)
+	mockQueryResult(mockSvc, [][]string{{"test"}})
+
+	engine := NewTestAthenaQueryEngine(mockSvc, metrics.NullFactory)
+
+	rows, err := engine.Query(ctx, QueryKindGetTrace, "SELECT span_payload FROM jaeger_spans")
+	assert.NoError(err)
+	assert.Equal([]QueryRow{{"test"}}, rows)
+}
+
+func TestAthenaQueryEngineRetriesFailedCachedQuery(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	submissionDateTime := time.Now()
+
+	mockSvc := mocks.NewMockAthenaAPI(ctrl)
+	mockSvc.EXPECT().ListQueryExecutions(gomock.Any(), gomock.Any()).
+		Return(&athena.ListQueryExecutionsOutput{QueryExecutionIds: []string{"cached"}}, nil)
+	mockSvc.EXPECT().BatchGetQueryExecution(gomock.Any(), gomock.Any()).
+		Return(&athena.BatchGetQueryExecutionOutput{
+			QueryExecutions: []types.QueryExecution{
+				{
+					Query:            aws.String("SELECT distinct service_name FROM jaeger_operations"),
+					QueryExecutionId: aws.String("cached"),
+					Status: &types.QueryExecutionStatus{
+						State:              types.QueryExecutionStateRunning,
+						SubmissionDateTime: &submissionDateTime,
+					},
+				},
+			},
+		}, nil)
+	gomock.InOrder(
+		mockSvc.EXPECT().GetQueryExecution(gomock.Any(), gomock.Any()).
+			Return(completedQueryExecution("cached", types.QueryExecutionStateCancelled, nil, "Query cancelled"), nil),
+		mockSvc.EXPECT().GetQueryExecution(gomock.Any(), gomock.Any()).
+			Return(completedQueryExecution("q1", types.QueryExecutionStateSucceeded, nil, ""), nil),
+	)
+	mockQueryStart(mockSvc, "q1")
+	mockQueryResult(mockSvc, [][]string{{"test"}})
+
+	engine := NewTestAthenaQueryEngine(mockSvc, metrics.NullFactory)
+
+	rows, err := engine.QueryCached(ctx, QueryKindGetServices, "SELECT distinct service_name FROM jaeger_operations", "SELECT distinct service_name", time.Minute)
+	assert.NoError(err)
+	assert.Equal([]QueryRow{{"test"}}, rows)
+}
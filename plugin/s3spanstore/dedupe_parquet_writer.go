@@ -59,6 +59,10 @@ func (w *DedupeParquetWriter) Write(ctx context.Context, rowTime time.Time, maxB
 	return nil
 }
 
+func (w *DedupeParquetWriter) FlushStats() FlushStats {
+	return w.parquetWriter.FlushStats()
+}
+
 func (w *DedupeParquetWriter) Close() error {
 	return w.parquetWriter.Close()
 }
@@ -46,6 +46,10 @@ func (w *testWriter) Write(ctx context.Context, time time.Time, maxBufferUntil t
 	return nil
 }
 
+func (w *testWriter) FlushStats() FlushStats {
+	return FlushStats{}
+}
+
 func (w *testWriter) Close() error {
 	return nil
 }
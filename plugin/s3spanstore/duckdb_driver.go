@@ -0,0 +1,6 @@
+//go:build duckdb
+
+package s3spanstore
+
+// Registers the DuckDB database/sql driver, which requires cgo.
+import _ "github.com/marcboeker/go-duckdb"
@@ -0,0 +1,203 @@
+package s3spanstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/opentracing/opentracing-go"
+)
+
+const (
+	DUCKDB_DRIVER_NAME = "duckdb"
+)
+
+// DuckDBQueryEngine executes queries using an embedded DuckDB reading the parquet files
+// from a local directory, which follows the same layout as the S3 bucket. The DuckDB
+// driver requires cgo and is only linked when building with the `duckdb` build tag.
+type DuckDBQueryEngine struct {
+	logger hclog.Logger
+	db     *sql.DB
+
+	// DuckDB fails to create views over prefixes without any files, so views are
+	// created lazily once the first files have been written.
+	pendingViews      map[string]string
+	pendingViewsMutex sync.Mutex
+}
+
+// DuckDBTable describes where the parquet files of a table are stored
+type DuckDBTable struct {
+	Prefix     string
+	Partitions PartitionScheme
+}
+
+// NewDuckDBQueryEngine creates a view for every table, reading all parquet files below the table prefix.
+func NewDuckDBQueryEngine(ctx context.Context, logger hclog.Logger, directory string, tables map[string]DuckDBTable) (*DuckDBQueryEngine, error) {
+	db, err := sql.Open(DUCKDB_DRIVER_NAME, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open duckdb, ensure the plugin was built with the duckdb build tag: %w", err)
+	}
+
+	absDirectory, err := filepath.Abs(directory)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to resolve directory: %w", err)
+	}
+
+	pendingViews := map[string]string{}
+	for tableName, table := range tables {
+		pendingViews[tableName] = duckDBViewStatement(absDirectory, tableName, table)
+	}
+
+	e := &DuckDBQueryEngine{logger: logger, db: db, pendingViews: pendingViews}
+	if err := e.createPendingViews(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (e *DuckDBQueryEngine) createPendingViews(ctx context.Context) error {
+	e.pendingViewsMutex.Lock()
+	defer e.pendingViewsMutex.Unlock()
+
+	for tableName, statement := range e.pendingViews {
+		if _, err := e.db.ExecContext(ctx, statement); err != nil {
+			if isDuckDBNoFilesError(err) {
+				continue
+			}
+
+			return fmt.Errorf("failed to create view %s: %w", tableName, err)
+		}
+
+		delete(e.pendingViews, tableName)
+	}
+
+	return nil
+}
+
+func (e *DuckDBQueryEngine) hasPendingViews() bool {
+	e.pendingViewsMutex.Lock()
+	defer e.pendingViewsMutex.Unlock()
+
+	return len(e.pendingViews) > 0
+}
+
+func isDuckDBNoFilesError(err error) bool {
+	return strings.Contains(err.Error(), "No files found")
+}
+
+// duckDBViewStatement returns a statement creating a view over all parquet files below the table prefix,
+// exposing the partition path as datehour and service_partition columns like the Athena partition projection.
+func duckDBViewStatement(directory string, tableName string, table DuckDBTable) string {
+	basePath := filepath.ToSlash(filepath.Join(directory, table.Prefix)) + "/"
+
+	partitionColumns := fmt.Sprintf(`regexp_extract(filename, %s, 1) AS datehour`, sqlString("^"+regexp.QuoteMeta(basePath)+"(.*)/[^/]+$"))
+	if table.Partitions.ServiceNamePartitioned() {
+		pattern := sqlString("^" + regexp.QuoteMeta(basePath) + "(.*)/([^/]+)/[^/]+$")
+		partitionColumns = fmt.Sprintf(`regexp_extract(filename, %s, 1) AS datehour, regexp_extract(filename, %s, 2) AS service_partition`, pattern, pattern)
+	}
+
+	return fmt.Sprintf(`CREATE OR REPLACE VIEW %s AS
+SELECT *, %s
+FROM read_parquet(%s, filename = true, union_by_name = true)`,
+		sqlIdentifier(tableName),
+		partitionColumns,
+		sqlString(basePath+"**/*.parquet"))
+}
+
+// DuckDB returns a list for map subscripts, so the first element needs to be extracted
+func (e *DuckDBQueryEngine) MapElement(column string, key string) string {
+	return fmt.Sprintf(`%s[%s][1]`, column, sqlString(key))
+}
+
+func (e *DuckDBQueryEngine) AnyElement(column string, variable string, condition string) string {
+	return fmt.Sprintf(`len(list_filter(%s, %s -> %s)) > 0`, column, variable, condition)
+}
+
+// DuckDB returns blobs as raw bytes
+func (e *DuckDBQueryEngine) DecodeBinary(value string) ([]byte, error) {
+	return []byte(value), nil
+}
+
+func (e *DuckDBQueryEngine) QueryCached(ctx context.Context, kind QueryKind, query string, lookup string, ttl time.Duration) ([]QueryRow, error) {
+	return e.Query(ctx, kind, query)
+}
+
+func (e *DuckDBQueryEngine) Query(ctx context.Context, kind QueryKind, query string) ([]QueryRow, error) {
+	otSpan, _ := opentracing.StartSpanFromContext(ctx, "queryDuckDB")
+	defer otSpan.Finish()
+	otSpan.SetTag("query_kind", string(kind))
+
+	if err := e.createPendingViews(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := e.db.QueryContext(ctx, query)
+	if err != nil {
+		// Tables without any parquet files don't have a view yet or files have been removed since
+		if isDuckDBNoFilesError(err) || (e.hasPendingViews() && strings.Contains(err.Error(), "Catalog Error")) {
+			e.logger.Debug("DuckDB query referenced a table without files", "error", err)
+			return []QueryRow{}, nil
+		}
+
+		return nil, fmt.Errorf("failed to execute duckdb query: %w", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get columns: %w", err)
+	}
+
+	result := []QueryRow{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		valuePointers := make([]interface{}, len(columns))
+		for i := range values {
+			valuePointers[i] = &values[i]
+		}
+
+		if err := rows.Scan(valuePointers...); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		row := make(QueryRow, len(values))
+		for i, value := range values {
+			row[i] = queryValueToString(value)
+		}
+		result = append(result, row)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read rows: %w", err)
+	}
+
+	return result, nil
+}
+
+func queryValueToString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.UTC().Format(ATHENA_TIMEFORMAT)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (e *DuckDBQueryEngine) Close() error {
+	return e.db.Close()
+}
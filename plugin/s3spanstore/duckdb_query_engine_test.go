@@ -0,0 +1,415 @@
+//go:build duckdb
+
+package s3spanstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-lib/metrics"
+)
+
+func NewTestDuckDBReader(ctx context.Context, assert *assert.Assertions, directory string, partitions PartitionScheme) (*Reader, *DuckDBQueryEngine) {
+	loggerName := "jaeger-s3"
+
+	logLevel := os.Getenv("GRPC_STORAGE_PLUGIN_LOG_LEVEL")
+	if logLevel == "" {
+		logLevel = hclog.Debug.String()
+	}
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Level:      hclog.LevelFromString(logLevel),
+		Name:       loggerName,
+		JSONFormat: true,
+	})
+
+	engine, err := NewDuckDBQueryEngine(ctx, logger, directory, map[string]DuckDBTable{
+		"jaeger_spans":      {Prefix: "spans/", Partitions: partitions},
+		"jaeger_operations": {Prefix: "operations/", Partitions: partitions},
+	})
+	assert.NoError(err)
+
+	reader, err := NewReaderWithQueryEngine(ctx, logger, engine, config.Athena{
+		SpansTableName:      "jaeger_spans",
+		OperationsTableName: "jaeger_operations",
+		MaxSpanAge:          "336h",
+	}, partitions, nil)
+	assert.NoError(err)
+
+	return reader, engine
+}
+
+func writeTestDuckDBSpans(ctx context.Context, assert *assert.Assertions, directory string, partitions PartitionScheme, spans ...*model.Span) {
+	logger := hclog.New(&hclog.LoggerOptions{
+		Level:      hclog.Debug,
+		Name:       "jaeger-s3",
+		JSONFormat: true,
+	})
+
+	writer, err := NewWriter(ctx, logger, metrics.NullFactory, nil, config.S3{
+		SpansPrefix:      "spans/",
+		OperationsPrefix: "operations/",
+		LocalDirectory:   directory,
+	}, partitions)
+	assert.NoError(err)
+
+	for _, span := range spans {
+		assert.NoError(writer.WriteSpan(ctx, span))
+	}
+
+	assert.NoError(writer.Close())
+}
+
+func TestDuckDBQueryEngineWithoutFiles(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	reader, engine := NewTestDuckDBReader(ctx, assert, t.TempDir(), PartitionScheme{})
+	defer engine.Close()
+	defer reader.Close()
+
+	services, err := reader.GetServices(ctx)
+	assert.NoError(err)
+	assert.Empty(services)
+}
+
+func TestDuckDBQueryEngine(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	directory := t.TempDir()
+
+	parentSpan := NewTestSpan(assert)
+	parentSpan.StartTime = time.Now().UTC().Add(-time.Minute)
+
+	childSpan := NewTestSpanWithTagsAndReferences(assert)
+	childSpan.StartTime = time.Now().UTC().Add(-time.Minute)
+	childSpan.References = []model.SpanRef{
+		model.NewChildOfRef(parentSpan.TraceID, parentSpan.SpanID),
+	}
+
+	writeTestDuckDBSpans(ctx, assert, directory, PartitionScheme{}, parentSpan, childSpan)
+
+	reader, engine := NewTestDuckDBReader(ctx, assert, directory, PartitionScheme{})
+	defer engine.Close()
+	defer reader.Close()
+
+	services, err := reader.GetServices(ctx)
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"example-service-1", "query12-service"}, services)
+
+	operations, err := reader.GetOperations(ctx, spanstore.OperationQueryParameters{ServiceName: "query12-service"})
+	assert.NoError(err)
+	assert.Equal([]spanstore.Operation{{Name: "query12-operation", SpanKind: ""}}, operations)
+
+	trace, err := reader.GetTrace(ctx, parentSpan.TraceID)
+	assert.NoError(err)
+	assert.Len(trace.Spans, 1)
+	assert.Equal(parentSpan.SpanID, trace.Spans[0].SpanID)
+
+	traces, err := reader.FindTraces(ctx, &spanstore.TraceQueryParameters{
+		ServiceName: "query12-service",
+		Tags:        map[string]string{"sameplacetag1": "sameplacevalue"},
+		NumTraces:   20,
+	})
+	assert.NoError(err)
+	assert.Len(traces, 1)
+	assert.Equal(childSpan.TraceID, traces[0].Spans[0].TraceID)
+
+	traces, err = reader.FindTraces(ctx, &spanstore.TraceQueryParameters{
+		ServiceName: "query12-service",
+		Tags:        map[string]string{"sameplacetag2": ">=100", "sameplacetag3": "72.50", "sameplacetag4": "true"},
+		NumTraces:   20,
+	})
+	assert.NoError(err)
+	assert.Len(traces, 1)
+
+	traces, err = reader.FindTraces(ctx, &spanstore.TraceQueryParameters{
+		ServiceName: "query12-service",
+		Tags:        map[string]string{"sameplacetag2": ">200"},
+		NumTraces:   20,
+	})
+	assert.NoError(err)
+	assert.Empty(traces)
+
+	traces, err = reader.FindTraces(ctx, &spanstore.TraceQueryParameters{
+		ServiceName: "query12-service",
+		Tags:        map[string]string{"sameplacetag1": "' OR '1'='1"},
+		NumTraces:   20,
+	})
+	assert.NoError(err)
+	assert.Empty(traces)
+
+	dependencies, err := reader.GetDependencies(ctx, time.Now(), time.Hour)
+	assert.NoError(err)
+	assert.Equal([]model.DependencyLink{{Parent: "example-service-1", Child: "query12-service", CallCount: 1}}, dependencies)
+}
+
+func TestDuckDBQueryEngineServicePartitions(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	directory := t.TempDir()
+
+	// example-service-1 isn't listed, so it's written into the shared service partition
+	partitions, err := NewPartitionScheme(config.Partitioning{ServiceName: true, ServiceNames: []string{"query12-service"}})
+	assert.NoError(err)
+
+	parentSpan := NewTestSpan(assert)
+	parentSpan.StartTime = time.Now().UTC().Add(-time.Minute)
+
+	childSpan := NewTestSpanWithTagsAndReferences(assert)
+	childSpan.StartTime = time.Now().UTC().Add(-time.Minute)
+
+	writeTestDuckDBSpans(ctx, assert, directory, partitions, parentSpan, childSpan)
+
+	entries, err := os.ReadDir(filepath.Join(directory, "spans", filepath.FromSlash(partitions.Key(childSpan.StartTime))))
+	assert.NoError(err)
+	assert.Len(entries, 2)
+
+	reader, engine := NewTestDuckDBReader(ctx, assert, directory, partitions)
+	defer engine.Close()
+	defer reader.Close()
+
+	services, err := reader.GetServices(ctx)
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"example-service-1", "query12-service"}, services)
+
+	operations, err := reader.GetOperations(ctx, spanstore.OperationQueryParameters{ServiceName: "query12-service"})
+	assert.NoError(err)
+	assert.Equal([]spanstore.Operation{{Name: "query12-operation", SpanKind: ""}}, operations)
+
+	trace, err := reader.GetTrace(ctx, parentSpan.TraceID)
+	assert.NoError(err)
+	assert.Len(trace.Spans, 1)
+
+	traces, err := reader.FindTraces(ctx, &spanstore.TraceQueryParameters{
+		ServiceName: "query12-service",
+		NumTraces:   20,
+	})
+	assert.NoError(err)
+	assert.Len(traces, 1)
+	assert.Equal(childSpan.TraceID, traces[0].Spans[0].TraceID)
+
+	traces, err = reader.FindTraces(ctx, &spanstore.TraceQueryParameters{
+		ServiceName: "example-service-1",
+		NumTraces:   20,
+	})
+	assert.NoError(err)
+	assert.Len(traces, 1)
+	assert.Equal(parentSpan.TraceID, traces[0].Spans[0].TraceID)
+}
+
+func TestDuckDBQueryEngineLogFields(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	directory := t.TempDir()
+
+	span := NewTestSpan(assert)
+	span.StartTime = time.Now().UTC().Add(-time.Minute)
+	span.Tags = []model.KeyValue{model.String("error", "false")}
+	span.Process.Tags = []model.KeyValue{model.String("hostname", "host-1")}
+	span.Logs = []model.Log{
+		{Timestamp: span.StartTime, Fields: []model.KeyValue{model.String("event", "retry"), model.String("error", "true")}},
+	}
+
+	writeTestDuckDBSpans(ctx, assert, directory, PartitionScheme{}, span)
+
+	reader, engine := NewTestDuckDBReader(ctx, assert, directory, PartitionScheme{})
+	defer engine.Close()
+	defer reader.Close()
+
+	for _, tags := range []map[string]string{
+		{"event": "retry"},
+		{"hostname": "host-1"},
+		{"error": "false"},
+		{"error": "true"},
+	} {
+		traces, err := reader.FindTraces(ctx, &spanstore.TraceQueryParameters{
+			ServiceName: span.Process.ServiceName,
+			Tags:        tags,
+			NumTraces:   20,
+		})
+		assert.NoError(err)
+		assert.Len(traces, 1, "%v", tags)
+	}
+
+	traces, err := reader.FindTraces(ctx, &spanstore.TraceQueryParameters{
+		ServiceName: span.Process.ServiceName,
+		Tags:        map[string]string{"event": "done"},
+		NumTraces:   20,
+	})
+	assert.NoError(err)
+	assert.Empty(traces)
+}
+
+func TestDuckDBQueryEnginePromotedTags(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	directory := t.TempDir()
+
+	span := NewTestSpan(assert)
+	span.StartTime = time.Now().UTC().Add(-time.Minute)
+	span.Tags = []model.KeyValue{model.String("error", "false")}
+	span.Process.Tags = []model.KeyValue{model.String("hostname", "host-1")}
+	span.Logs = []model.Log{
+		{Timestamp: span.StartTime, Fields: []model.KeyValue{model.String("event", "retry"), model.String("error", "true")}},
+	}
+
+	writer, err := NewWriter(ctx, hclog.NewNullLogger(), metrics.NullFactory, nil, config.S3{
+		SpansPrefix:      "spans/",
+		OperationsPrefix: "operations/",
+		LocalDirectory:   directory,
+		PromotedTags:     []string{"error", "event", "hostname"},
+	}, PartitionScheme{})
+	assert.NoError(err)
+	assert.NoError(writer.WriteSpan(ctx, span))
+	assert.NoError(writer.Close())
+
+	// Written an hour before the tags were promoted, so the file doesn't contain the columns
+	unpromotedSpan := NewTestSpan(assert)
+	unpromotedSpan.TraceID = model.NewTraceID(0, 2)
+	unpromotedSpan.StartTime = span.StartTime.Add(-time.Hour)
+	unpromotedSpan.Tags = []model.KeyValue{model.String("event", "retry")}
+	writeTestDuckDBSpans(ctx, assert, directory, PartitionScheme{}, unpromotedSpan)
+
+	reader, engine := NewTestDuckDBReader(ctx, assert, directory, PartitionScheme{})
+	defer engine.Close()
+	defer reader.Close()
+
+	promotedReader, err := NewReaderWithQueryEngine(ctx, hclog.NewNullLogger(), engine, config.Athena{
+		SpansTableName:      "jaeger_spans",
+		OperationsTableName: "jaeger_operations",
+		MaxSpanAge:          "336h",
+	}, PartitionScheme{}, []string{"error", "event", "hostname"})
+	assert.NoError(err)
+	defer promotedReader.Close()
+
+	// Promoting tags doesn't change the matching spans
+	for _, tt := range []struct {
+		tags   map[string]string
+		traces int
+	}{
+		{tags: map[string]string{"event": "retry"}, traces: 2},
+		{tags: map[string]string{"hostname": "host-1"}, traces: 1},
+		{tags: map[string]string{"error": "false"}, traces: 1},
+		// The column only contains the span tag, the log field of the same key is matched using the tag maps
+		{tags: map[string]string{"error": "true"}, traces: 1},
+	} {
+		for _, r := range []*Reader{reader, promotedReader} {
+			traces, err := r.FindTraces(ctx, &spanstore.TraceQueryParameters{
+				ServiceName: span.Process.ServiceName,
+				Tags:        tt.tags,
+				NumTraces:   20,
+			})
+			assert.NoError(err)
+			assert.Len(traces, tt.traces, "%v", tt.tags)
+		}
+	}
+}
+
+// legacySpanRecord contains the columns of span records written before the parent span id was stored
+type legacySpanRecord struct {
+	TraceID       string                 `parquet:"name=trace_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN"`
+	SpanID        string                 `parquet:"name=span_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN"`
+	ServiceName   string                 `parquet:"name=service_name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	StartTime     int64                  `parquet:"name=start_time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	References    []SpanRecordReferences `parquet:"name=references"`
+	SchemaVersion int32                  `parquet:"name=schema_version, type=INT32"`
+}
+
+func newTestDependencySpan(assert *assert.Assertions, traceID model.TraceID, spanID uint64, serviceName string, references ...model.SpanRef) *model.Span {
+	span := NewTestSpan(assert)
+	span.TraceID = traceID
+	span.SpanID = model.NewSpanID(spanID)
+	span.StartTime = time.Now().UTC().Add(-time.Minute)
+	span.Process.ServiceName = serviceName
+	span.References = references
+
+	return span
+}
+
+func TestDuckDBQueryEngineParentSpans(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	directory := t.TempDir()
+
+	traceID := model.NewTraceID(0, 1)
+	frontendSpan := newTestDependencySpan(assert, traceID, 1, "frontend")
+	// Only references its parent, so the parent span id is used
+	backendSpan := newTestDependencySpan(assert, traceID, 2, "backend", model.NewChildOfRef(traceID, frontendSpan.SpanID))
+	// All references of spans with references besides their parent are used
+	workerSpan := newTestDependencySpan(assert, traceID, 3, "worker",
+		model.NewChildOfRef(traceID, backendSpan.SpanID),
+		model.NewFollowsFromRef(traceID, frontendSpan.SpanID))
+
+	writeTestDuckDBSpans(ctx, assert, directory, PartitionScheme{}, frontendSpan, backendSpan, workerSpan)
+
+	// Files written by previous versions don't contain the parent span id. The instance id keeps the
+	// file names distinct from the files written above.
+	legacyWriter, err := NewParquetWriter(ctx, hclog.NewNullLogger(), metrics.NullFactory, NewLocalParquetFileSink(directory), "spans/", new(legacySpanRecord), ParquetWriterOptions{BufferDuration: time.Hour, InstanceID: "legacy"})
+	assert.NoError(err)
+
+	legacyTraceID := model.NewTraceID(0, 2)
+	for _, span := range []*model.Span{
+		newTestDependencySpan(assert, legacyTraceID, 1, "legacy-frontend"),
+		newTestDependencySpan(assert, legacyTraceID, 2, "legacy-backend", model.NewChildOfRef(legacyTraceID, model.NewSpanID(1))),
+	} {
+		assert.NoError(legacyWriter.Write(ctx, span.StartTime, span.StartTime, &legacySpanRecord{
+			TraceID:       span.TraceID.String(),
+			SpanID:        span.SpanID.String(),
+			ServiceName:   span.Process.ServiceName,
+			StartTime:     span.StartTime.UnixMilli(),
+			References:    NewSpanRecordReferencesFromSpanReferences(span),
+			SchemaVersion: SCHEMA_VERSION_BINARY_PAYLOAD,
+		}))
+	}
+	assert.NoError(legacyWriter.Close())
+
+	reader, engine := NewTestDuckDBReader(ctx, assert, directory, PartitionScheme{})
+	defer engine.Close()
+	defer reader.Close()
+
+	dependencies, err := reader.GetDependencies(ctx, time.Now(), time.Hour)
+	assert.NoError(err)
+	assert.ElementsMatch([]model.DependencyLink{
+		{Parent: "frontend", Child: "backend", CallCount: 1},
+		{Parent: "backend", Child: "worker", CallCount: 1},
+		{Parent: "frontend", Child: "worker", CallCount: 1},
+		{Parent: "legacy-frontend", Child: "legacy-backend", CallCount: 1},
+	}, dependencies)
+
+	for _, tt := range []struct {
+		serviceName string
+		root        string
+		found       bool
+	}{
+		{serviceName: "frontend", root: "true", found: true},
+		{serviceName: "frontend", root: "false", found: false},
+		{serviceName: "backend", root: "true", found: false},
+		{serviceName: "backend", root: "false", found: true},
+		{serviceName: "legacy-frontend", root: "true", found: true},
+		{serviceName: "legacy-frontend", root: "false", found: false},
+		{serviceName: "legacy-backend", root: "true", found: false},
+		{serviceName: "legacy-backend", root: "false", found: true},
+	} {
+		traceIDs, err := reader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+			ServiceName: tt.serviceName,
+			Tags:        map[string]string{ROOT_SPAN_SEARCH_KEY: tt.root},
+			NumTraces:   20,
+		})
+		assert.NoError(err)
+		assert.Equal(tt.found, len(traceIDs) == 1, "%s is_root=%s", tt.serviceName, tt.root)
+	}
+}
@@ -0,0 +1,274 @@
+package s3spanstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/hashicorp/go-hclog"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/uber/jaeger-lib/metrics"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+const (
+	s3AbortMultipartUploadTimeout = 30 * time.Second
+)
+
+var (
+	errParquetFileAborted   = errors.New("parquet file aborted")
+	errParquetFileWriteOnly = errors.New("parquet file is write only")
+)
+
+// ParquetFileSink creates the files parquet data is written to, so spans can be stored
+// in S3, an S3 compatible service or a local directory.
+type ParquetFileSink interface {
+	CreateFile(ctx context.Context, key string) (source.ParquetFile, error)
+	Empty(ctx context.Context) error
+	Close() error
+}
+
+// AbortableParquetFile is implemented by files, which clean up partially written data
+// when they are abandoned instead of being closed.
+type AbortableParquetFile interface {
+	source.ParquetFile
+	Abort() error
+}
+
+// SpillableParquetFile is implemented by files, which are kept locally when failing to upload. Closing
+// them returns errParquetFileSpilled in that case and they are uploaded later in the background.
+type SpillableParquetFile interface {
+	source.ParquetFile
+	// OnUploaded registers a callback, which is called once a spilled file got uploaded
+	OnUploaded(func())
+}
+
+func NewParquetFileSink(logger hclog.Logger, metricsFactory metrics.Factory, svc S3API, s3Config config.S3) (ParquetFileSink, error) {
+	if s3Config.LocalDirectory != "" {
+		return NewLocalParquetFileSink(s3Config.LocalDirectory), nil
+	}
+
+	if s3Config.SpillDirectory != "" {
+		sink, err := NewSpillParquetFileSink(logger, metricsFactory, svc, s3Config.BucketName, s3Config.SpillDirectory)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create spill parquet file sink: %w", err)
+		}
+
+		return sink, nil
+	}
+
+	return NewS3ParquetFileSink(svc, s3Config.BucketName), nil
+}
+
+type S3ParquetFileSink struct {
+	svc        S3API
+	bucketName string
+}
+
+func NewS3ParquetFileSink(svc S3API, bucketName string) *S3ParquetFileSink {
+	return &S3ParquetFileSink{svc: svc, bucketName: bucketName}
+}
+
+func (s *S3ParquetFileSink) CreateFile(ctx context.Context, key string) (source.ParquetFile, error) {
+	return newS3ParquetFile(ctx, s.svc, s.bucketName, key), nil
+}
+
+func (s *S3ParquetFileSink) Empty(ctx context.Context) error {
+	return EmptyBucket(ctx, s.svc, s.bucketName)
+}
+
+func (s *S3ParquetFileSink) Close() error {
+	return nil
+}
+
+// s3ParquetFile streams parquet data into S3. Contrary to s3v2.S3File a failed or aborted multipart
+// upload is always aborted, so already uploaded parts never linger in the bucket.
+type s3ParquetFile struct {
+	svc        S3API
+	bucketName string
+	key        string
+
+	pipeWriter *io.PipeWriter
+	uploadDone chan error
+}
+
+func newS3ParquetFile(ctx context.Context, svc S3API, bucketName string, key string) *s3ParquetFile {
+	pipeReader, pipeWriter := io.Pipe()
+
+	f := &s3ParquetFile{
+		svc:        svc,
+		bucketName: bucketName,
+		key:        key,
+		pipeWriter: pipeWriter,
+		uploadDone: make(chan error, 1),
+	}
+
+	uploader := manager.NewUploader(svc, func(u *manager.Uploader) {
+		// Parts are aborted explicitly, as the uploader ignores abort failures
+		u.LeavePartsOnError = true
+	})
+
+	go func() {
+		_, err := uploader.Upload(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(key),
+			Body:   pipeReader,
+		})
+		if err != nil {
+			err = f.abortMultipartUpload(err)
+
+			// Unblock pending writes
+			pipeReader.CloseWithError(err)
+		}
+
+		f.uploadDone <- err
+	}()
+
+	return f
+}
+
+func (f *s3ParquetFile) abortMultipartUpload(uploadErr error) error {
+	var multiUploadErr manager.MultiUploadFailure
+	if !errors.As(uploadErr, &multiUploadErr) {
+		return uploadErr
+	}
+
+	// The upload context might have been cancelled already
+	ctx, cancel := context.WithTimeout(context.Background(), s3AbortMultipartUploadTimeout)
+	defer cancel()
+
+	if _, err := f.svc.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(f.bucketName),
+		Key:      aws.String(f.key),
+		UploadId: aws.String(multiUploadErr.UploadID()),
+	}); err != nil {
+		return errors.Join(uploadErr, fmt.Errorf("failed to abort multipart upload %s: %w", multiUploadErr.UploadID(), err))
+	}
+
+	return uploadErr
+}
+
+func (f *s3ParquetFile) Write(p []byte) (int, error) {
+	return f.pipeWriter.Write(p)
+}
+
+// Close completes the upload and blocks until it finished
+func (f *s3ParquetFile) Close() error {
+	if err := f.pipeWriter.Close(); err != nil {
+		return fmt.Errorf("failed to close pipe: %w", err)
+	}
+
+	if err := <-f.uploadDone; err != nil {
+		return fmt.Errorf("failed to upload %s: %w", f.key, err)
+	}
+
+	return nil
+}
+
+// Abort stops the upload and removes already uploaded parts
+func (f *s3ParquetFile) Abort() error {
+	f.pipeWriter.CloseWithError(errParquetFileAborted)
+
+	// The upload might have failed before it got aborted
+	if err := <-f.uploadDone; err != nil && !errors.Is(err, errParquetFileAborted) {
+		return fmt.Errorf("failed to upload %s: %w", f.key, err)
+	}
+
+	return nil
+}
+
+func (f *s3ParquetFile) Create(name string) (source.ParquetFile, error) {
+	return nil, fmt.Errorf("failed to create %s: nested files are not supported", name)
+}
+
+func (f *s3ParquetFile) Open(name string) (source.ParquetFile, error) {
+	return nil, errParquetFileWriteOnly
+}
+
+func (f *s3ParquetFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, errParquetFileWriteOnly
+}
+
+func (f *s3ParquetFile) Read(p []byte) (int, error) {
+	return 0, errParquetFileWriteOnly
+}
+
+// LocalParquetFileSink writes parquet files into a local directory using the same layout as in S3.
+type LocalParquetFileSink struct {
+	directory string
+}
+
+func NewLocalParquetFileSink(directory string) *LocalParquetFileSink {
+	return &LocalParquetFileSink{directory: directory}
+}
+
+func (s *LocalParquetFileSink) CreateFile(ctx context.Context, key string) (source.ParquetFile, error) {
+	path := filepath.Join(s.directory, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// Write into a temporary file first, so readers never see partially written files
+	file, err := local.NewLocalFileWriter(path + ".tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+
+	return &localParquetFile{ParquetFile: file, path: path}, nil
+}
+
+func (s *LocalParquetFileSink) Empty(ctx context.Context) error {
+	entries, err := os.ReadDir(s.directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(s.directory, entry.Name())); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", entry.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+func (s *LocalParquetFileSink) Close() error {
+	return nil
+}
+
+type localParquetFile struct {
+	source.ParquetFile
+	path string
+}
+
+func (f *localParquetFile) Close() error {
+	if err := f.ParquetFile.Close(); err != nil {
+		os.Remove(f.path + ".tmp")
+		return err
+	}
+
+	return os.Rename(f.path+".tmp", f.path)
+}
+
+// Abort removes the partially written temporary file
+func (f *localParquetFile) Abort() error {
+	closeErr := f.ParquetFile.Close()
+
+	if err := os.Remove(f.path + ".tmp"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", f.path+".tmp", err)
+	}
+
+	return closeErr
+}
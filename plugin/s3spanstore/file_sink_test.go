@@ -0,0 +1,99 @@
+package s3spanstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/golang/mock/gomock"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+// Writing more than a single part (5MB) switches to a multipart upload
+var multipartUploadPayload = []byte(strings.Repeat("x", 6*1024*1024))
+
+func TestS3ParquetFileAbortsFailedMultipartUpload(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc.EXPECT().CreateMultipartUpload(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil)
+	mockSvc.EXPECT().UploadPart(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(nil, errors.New("upload part failed")).AnyTimes()
+	mockSvc.EXPECT().AbortMultipartUpload(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, input *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+			assert.Equal("jaeger-spans", aws.ToString(input.Bucket))
+			assert.Equal("spans/file.parquet", aws.ToString(input.Key))
+			assert.Equal("upload-1", aws.ToString(input.UploadId))
+			return &s3.AbortMultipartUploadOutput{}, nil
+		})
+
+	file := newS3ParquetFile(ctx, mockSvc, "jaeger-spans", "spans/file.parquet")
+
+	// Writes fail once the upload failed
+	_, _ = file.Write(multipartUploadPayload)
+
+	err := file.Close()
+	assert.Error(err)
+	assert.Contains(err.Error(), "upload part failed")
+}
+
+func TestS3ParquetFileAbort(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc.EXPECT().CreateMultipartUpload(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil)
+	mockSvc.EXPECT().UploadPart(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(&s3.UploadPartOutput{ETag: aws.String("etag")}, nil).AnyTimes()
+	mockSvc.EXPECT().AbortMultipartUpload(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, input *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+			assert.Equal("upload-1", aws.ToString(input.UploadId))
+			return &s3.AbortMultipartUploadOutput{}, nil
+		})
+
+	file := newS3ParquetFile(ctx, mockSvc, "jaeger-spans", "spans/file.parquet")
+
+	_, err := file.Write(multipartUploadPayload)
+	assert.NoError(err)
+
+	assert.NoError(file.Abort())
+}
+
+func TestLocalParquetFileAbort(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	directory := t.TempDir()
+	sink := NewLocalParquetFileSink(directory)
+
+	file, err := sink.CreateFile(ctx, "spans/2017/01/26/16/file.parquet")
+	assert.NoError(err)
+
+	_, err = file.Write([]byte("partial"))
+	assert.NoError(err)
+
+	abortableFile, ok := file.(AbortableParquetFile)
+	assert.True(ok)
+	assert.NoError(abortableFile.Abort())
+
+	entries, err := os.ReadDir(filepath.Join(directory, "spans", "2017", "01", "26", "16"))
+	assert.NoError(err)
+	assert.Empty(entries)
+}
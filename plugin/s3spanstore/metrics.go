@@ -0,0 +1,119 @@
+package s3spanstore
+
+import (
+	"github.com/uber/jaeger-lib/metrics"
+)
+
+// WriterMetrics are emitted by the span and archive writers
+type WriterMetrics struct {
+	SpansWritten metrics.Counter `metric:"spans_written" help:"Number of spans written"`
+	SpansFailed  metrics.Counter `metric:"spans_failed" help:"Number of spans failed to be written"`
+	// SpansUnlistedService are written into the shared service partition
+	SpansUnlistedService metrics.Counter `metric:"spans_unlisted_service" help:"Number of spans of services without their own service partition"`
+}
+
+// WriteBufferMetrics are emitted by the write buffer in front of the span parquet writer
+type WriteBufferMetrics struct {
+	SpansDropped  metrics.Counter `metric:"write_buffer_spans_dropped" help:"Number of spans dropped due to an exhausted write buffer"`
+	SpansRejected metrics.Counter `metric:"write_buffer_spans_rejected" help:"Number of spans rejected due to an exhausted write buffer"`
+	SpansFailed   metrics.Counter `metric:"write_buffer_spans_failed" help:"Number of buffered spans, which failed to be written after they were accepted"`
+	BufferedBytes metrics.Gauge   `metric:"write_buffer_bytes" help:"Approximate size of spans buffered in memory"`
+}
+
+// ParquetWriterMetrics are emitted by every parquet writer, tagged with the kind of rows written
+type ParquetWriterMetrics struct {
+	RowsWritten   metrics.Counter `metric:"parquet_rows_written" help:"Number of rows written into parquet files"`
+	FilesFlushed  metrics.Counter `metric:"parquet_files_flushed" help:"Number of parquet files flushed"`
+	FlushErrors   metrics.Counter `metric:"parquet_flush_errors" help:"Number of parquet files failed to be flushed"`
+	FilesAborted  metrics.Counter `metric:"parquet_files_aborted" help:"Number of partially written parquet files aborted"`
+	FlushDuration metrics.Timer   `metric:"parquet_flush_duration" help:"Duration to flush and upload a parquet file"`
+}
+
+// SpillMetrics are emitted by the spill parquet file sink
+type SpillMetrics struct {
+	FilesSpilled   metrics.Counter `metric:"spill_files" help:"Number of parquet files failed to upload and kept in the spill directory"`
+	FilesRecovered metrics.Counter `metric:"spill_files_recovered" help:"Number of spilled parquet files uploaded on retry"`
+	RetryErrors    metrics.Counter `metric:"spill_retry_errors" help:"Number of failed retries to upload spilled parquet files"`
+	FilesFailed    metrics.Counter `metric:"spill_files_failed" help:"Number of spilled parquet files, which failed to upload with a non-retryable error"`
+}
+
+// AthenaMetrics are emitted by the Athena query engine, tagged with the kind of query
+type AthenaMetrics struct {
+	Queries       metrics.Counter `metric:"athena_queries" help:"Number of Athena queries executed"`
+	QueryErrors   metrics.Counter `metric:"athena_query_errors" help:"Number of Athena queries failed"`
+	QueryRetries  metrics.Counter `metric:"athena_query_retries" help:"Number of Athena queries retried after a transient failure"`
+	QueryDuration metrics.Timer   `metric:"athena_query_duration" help:"Duration of Athena queries including fetching the results"`
+}
+
+// AthenaStatisticsMetrics are emitted for every Athena query execution, tagged with the kind of query
+// and the final state of the execution, as failed and cancelled executions are billed as well
+type AthenaStatisticsMetrics struct {
+	DataScannedBytes    metrics.Counter `metric:"athena_data_scanned_bytes" help:"Number of bytes scanned by Athena query executions"`
+	EngineExecutionTime metrics.Timer   `metric:"athena_engine_execution_time" help:"Time Athena spent executing queries"`
+}
+
+// TrinoMetrics are emitted by the Trino query engine, tagged with the kind of query
+type TrinoMetrics struct {
+	Queries       metrics.Counter `metric:"trino_queries" help:"Number of Trino queries executed"`
+	QueryErrors   metrics.Counter `metric:"trino_query_errors" help:"Number of Trino queries failed"`
+	QueryDuration metrics.Timer   `metric:"trino_query_duration" help:"Duration of Trino queries including fetching the results"`
+}
+
+// AthenaQueryCacheMetrics are emitted by the Athena query cache
+type AthenaQueryCacheMetrics struct {
+	Hits   metrics.Counter `metric:"athena_query_cache_hits" help:"Number of Athena query cache lookups finding a previous query"`
+	Misses metrics.Counter `metric:"athena_query_cache_misses" help:"Number of Athena query cache lookups without a previous query"`
+}
+
+func newWriterMetrics(metricsFactory metrics.Factory) *WriterMetrics {
+	m := &WriterMetrics{}
+	metrics.MustInit(m, metricsFactory, nil)
+	return m
+}
+
+func newWriteBufferMetrics(metricsFactory metrics.Factory) *WriteBufferMetrics {
+	m := &WriteBufferMetrics{}
+	metrics.MustInit(m, metricsFactory, nil)
+	return m
+}
+
+func newParquetWriterMetrics(metricsFactory metrics.Factory) *ParquetWriterMetrics {
+	m := &ParquetWriterMetrics{}
+	metrics.MustInit(m, metricsFactory, nil)
+	return m
+}
+
+func newSpillMetrics(metricsFactory metrics.Factory) *SpillMetrics {
+	m := &SpillMetrics{}
+	metrics.MustInit(m, metricsFactory, nil)
+	return m
+}
+
+func newAthenaMetrics(metricsFactory metrics.Factory) *AthenaMetrics {
+	m := &AthenaMetrics{}
+	metrics.MustInit(m, metricsFactory, nil)
+	return m
+}
+
+func newTrinoMetrics(metricsFactory metrics.Factory) *TrinoMetrics {
+	m := &TrinoMetrics{}
+	metrics.MustInit(m, metricsFactory, nil)
+	return m
+}
+
+func newAthenaStatisticsMetrics(metricsFactory metrics.Factory) *AthenaStatisticsMetrics {
+	m := &AthenaStatisticsMetrics{}
+	metrics.MustInit(m, metricsFactory, nil)
+	return m
+}
+
+func newAthenaQueryCacheMetrics(metricsFactory metrics.Factory) *AthenaQueryCacheMetrics {
+	m := &AthenaQueryCacheMetrics{}
+	metrics.MustInit(m, metricsFactory, nil)
+	return m
+}
+
+// parquetWriterMetricsFactory tags all parquet writer metrics with the kind of rows written
+func parquetWriterMetricsFactory(metricsFactory metrics.Factory, kind string) metrics.Factory {
+	return metricsFactory.Namespace(metrics.NSOptions{Tags: map[string]string{"kind": kind}})
+}
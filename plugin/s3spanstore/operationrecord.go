@@ -23,6 +23,10 @@ func NewOperationRecordFromSpan(span *model.Span) (*OperationRecord, error) {
 	}, nil
 }
 
+func (w *OperationRecord) PartitionServiceName() string {
+	return w.ServiceName
+}
+
 func (w *OperationRecord) DedupeKey() string {
 	return fmt.Sprintf("%s/%s/%s", w.OperationName, w.SpanKind, w.ServiceName)
 }
@@ -2,79 +2,266 @@ package s3spanstore
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"math/rand"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/go-hclog"
-	"github.com/xitongsys/parquet-go-source/s3v2"
+	"github.com/uber/jaeger-lib/metrics"
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/layout"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/schema"
 	"github.com/xitongsys/parquet-go/source"
 	"github.com/xitongsys/parquet-go/writer"
 )
 
 const (
-	PARQUET_CONCURRENCY = 1
-	PARTION_FORMAT      = "2006/01/02/15"
+	PARQUET_CONCURRENCY      = 1
+	PARQUET_FILE_TIME_FORMAT = "20060102T150405Z"
 )
 
-const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+var ErrParquetWriterClosed = errors.New("parquet writer closed")
 
-func RandStringBytes(n int) string {
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+var (
+	defaultMaxConcurrentFlushes = 4
+	defaultRowGroupSize         = int64(128 * 1024 * 1024)
+	defaultPageSize             = int64(8 * 1024)
+
+	// Sorted files need multiple row groups, so lookups can skip row groups using their statistics
+	defaultSortedRowGroupSize = int64(8 * 1024 * 1024)
+	maxSortedRowGroupSize     = int64(32 * 1024 * 1024)
+)
+
+// ParseCompressionCodec returns the parquet compression codec of a configured codec name
+func ParseCompressionCodec(codec string) (parquet.CompressionCodec, error) {
+	switch strings.ToLower(codec) {
+	case "", "snappy":
+		return parquet.CompressionCodec_SNAPPY, nil
+	case "zstd":
+		return parquet.CompressionCodec_ZSTD, nil
+	case "gzip":
+		return parquet.CompressionCodec_GZIP, nil
+	case "none", "uncompressed":
+		return parquet.CompressionCodec_UNCOMPRESSED, nil
+	default:
+		return parquet.CompressionCodec_UNCOMPRESSED, fmt.Errorf("unknown compression codec %q", codec)
+	}
+}
+
+// Characters of instance IDs, which aren't safe to be used in object keys are replaced
+var unsafeInstanceIDCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// ParquetFileName identifies the writer instance, the time the writer started and the sequence
+// number of the file within the writer, e.g. jaeger-collector-0-20240102T150405Z-000042
+func ParquetFileName(instanceID string, start time.Time, seq uint64) string {
+	return fmt.Sprintf("%s-%s-%06d", instanceID, start.UTC().Format(PARQUET_FILE_TIME_FORMAT), seq)
+}
+
+// DefaultInstanceID returns the hostname, which is the pod name in Kubernetes
+func DefaultInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "jaeger-s3"
 	}
-	return string(b)
+
+	return SanitizeInstanceID(hostname)
 }
 
-func S3ParquetKey(prefix, suffix string, datehour string) string {
-	return prefix + datehour + "/" + suffix + ".parquet"
+func SanitizeInstanceID(instanceID string) string {
+	return unsafeInstanceIDCharacters.ReplaceAllString(instanceID, "_")
 }
 
-func S3PartitionKey(t time.Time) string {
-	return t.Format(PARTION_FORMAT)
+func S3ParquetKey(prefix, suffix string, partition string) string {
+	return prefix + partition + "/" + suffix + ".parquet"
 }
 
 type ParquetRef struct {
 	parquetWriteFile source.ParquetFile
 	parquetWriter    *writer.ParquetWriter
+
+	rows  int64
+	bytes int64
+
+	// sortedRows are buffered until the file is closed, when rows are sorted
+	sortedRows []interface{}
+}
+
+// SortableRow is ordered by its primary and secondary sort key, when sorting rows is enabled
+type SortableRow interface {
+	SortKey() (string, int64)
+}
+
+// ParquetSchema describes rows with columns, which can't be declared using struct tags. It is passed
+// as row type instead of the row struct.
+type ParquetSchema interface {
+	SchemaHandler() (*schema.SchemaHandler, error)
+	Marshal(rows []interface{}, schemaHandler *schema.SchemaHandler) (*map[string]*layout.Table, error)
+}
+
+// ParquetWriterOptions control when buffered rows are flushed into a new parquet file. Files are
+// rotated by whichever threshold is crossed first, a zero MaxFileRows or MaxFileBytes disables the threshold.
+type ParquetWriterOptions struct {
+	// InstanceID is part of every file name, so files can be traced back to the writing instance.
+	// Defaults to the hostname.
+	InstanceID     string
+	BufferDuration time.Duration
+	MaxFileRows    int64
+	// MaxFileBytes is compared to the approximate uncompressed size of the rows written
+	MaxFileBytes int64
+	// MaxConcurrentFlushes bounds the number of files flushed and uploaded in parallel, defaults to 4
+	MaxConcurrentFlushes int
+	// OnFileClosed is called with the approximate size of all rows in a file, once the file
+	// has been closed, independently of whether the upload succeeded.
+	OnFileClosed func(bytes int64)
+	// Partitions maps row times to the partition of the file the row is written into
+	Partitions PartitionScheme
+
+	// CompressionCodec is one of snappy (default), zstd, gzip or none
+	CompressionCodec string
+	// RowGroupSize and PageSize in bytes, default to 128MB (8MB for sorted files) and 8KB
+	RowGroupSize int64
+	PageSize     int64
+	// Concurrency is the number of goroutines marshalling rows, defaults to 1
+	Concurrency int64
+	// SortRows buffers all rows of a file and writes them ordered by their sort key on close, so
+	// the column statistics of row groups allow skipping row groups not containing a value. The
+	// buffered rows stay accounted in OnFileClosed until the file is closed. Row groups of sorted
+	// files are limited to 32MB.
+	SortRows bool
+}
+
+// approximateRowSize returns the approximate uncompressed size of a row
+func approximateRowSize(row interface{}) int64 {
+	return common.SizeOf(reflect.ValueOf(row))
+}
+
+// FlushStats counts rows and files of a parquet writer. Spilled files failed to upload and are kept
+// in the spill directory, until they are uploaded in the background or on the next startup.
+type FlushStats struct {
+	RowsWritten  int64
+	RowsFlushed  int64
+	RowsSpilled  int64
+	FilesFlushed int64
+	FilesSpilled int64
+	FilesFailed  int64
+}
+
+// RowsUnflushed returns the number of rows, which have neither been flushed nor spilled (yet)
+func (s FlushStats) RowsUnflushed() int64 {
+	return s.RowsWritten - s.RowsFlushed - s.RowsSpilled
+}
+
+func (s FlushStats) Add(other FlushStats) FlushStats {
+	return FlushStats{
+		RowsWritten:  s.RowsWritten + other.RowsWritten,
+		RowsFlushed:  s.RowsFlushed + other.RowsFlushed,
+		RowsSpilled:  s.RowsSpilled + other.RowsSpilled,
+		FilesFlushed: s.FilesFlushed + other.FilesFlushed,
+		FilesSpilled: s.FilesSpilled + other.FilesSpilled,
+		FilesFailed:  s.FilesFailed + other.FilesFailed,
+	}
 }
 
 type ParquetWriter struct {
-	logger     hclog.Logger
-	svc        S3API
-	bucketName string
-	prefix     string
-	ticker     *time.Ticker
-	done       chan bool
-	rowType    interface{}
+	logger  hclog.Logger
+	metrics *ParquetWriterMetrics
+	sink    ParquetFileSink
+	prefix  string
+	opts    ParquetWriterOptions
+	ticker  *time.Ticker
+	done    chan bool
+	stopped chan struct{}
+	rowType interface{}
+
+	compressionCodec parquet.CompressionCodec
+
+	// startTime and sequence make file names unique and deterministic per writer
+	startTime time.Time
+	sequence  uint64
 
 	parquetWriterRefs map[string]*ParquetRef
 	bufferMutex       sync.Mutex
 	bufferMaxUntil    *time.Time
 	ctx               context.Context
+	// closed is set by Close while holding the buffer mutex, rows written afterwards are rejected
+	closed bool
+
+	// Files rotated due to a crossed size threshold are closed in the background. They are added
+	// while holding the buffer mutex, so Close waits for all of them.
+	rotatedParquetWriters sync.WaitGroup
+	// flushSlots bounds the number of files flushed concurrently
+	flushSlots chan struct{}
+
+	statsMutex sync.Mutex
+	stats      FlushStats
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
 type IParquetWriter interface {
 	Write(ctx context.Context, time time.Time, maxBufferUntil time.Time, row interface{}) error
+	FlushStats() FlushStats
 	Close() error
 }
 
-func NewParquetWriter(ctx context.Context, logger hclog.Logger, svc S3API, bufferDuration time.Duration, bucketName string, prefix string, rowType interface{}) (*ParquetWriter, error) {
+func NewParquetWriter(ctx context.Context, logger hclog.Logger, metricsFactory metrics.Factory, sink ParquetFileSink, prefix string, rowType interface{}, opts ParquetWriterOptions) (*ParquetWriter, error) {
+	if opts.InstanceID == "" {
+		opts.InstanceID = DefaultInstanceID()
+	}
+
+	maxConcurrentFlushes := defaultMaxConcurrentFlushes
+	if opts.MaxConcurrentFlushes > 0 {
+		maxConcurrentFlushes = opts.MaxConcurrentFlushes
+	}
+
+	compressionCodec, err := ParseCompressionCodec(opts.CompressionCodec)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.RowGroupSize <= 0 {
+		opts.RowGroupSize = defaultRowGroupSize
+		if opts.SortRows {
+			opts.RowGroupSize = defaultSortedRowGroupSize
+		}
+	} else if opts.SortRows && opts.RowGroupSize > maxSortedRowGroupSize {
+		return nil, fmt.Errorf("row group size %d of sorted files exceeds the maximum of %d bytes", opts.RowGroupSize, maxSortedRowGroupSize)
+	}
+	if opts.PageSize <= 0 {
+		opts.PageSize = defaultPageSize
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = PARQUET_CONCURRENCY
+	}
+
 	w := &ParquetWriter{
-		svc:               svc,
-		bucketName:        bucketName,
+		sink:              sink,
 		prefix:            prefix,
+		opts:              opts,
 		logger:            logger,
-		ticker:            time.NewTicker(bufferDuration),
+		metrics:           newParquetWriterMetrics(metricsFactory),
+		ticker:            time.NewTicker(opts.BufferDuration),
 		done:              make(chan bool),
+		stopped:           make(chan struct{}),
+		startTime:         time.Now(),
 		parquetWriterRefs: map[string]*ParquetRef{},
 		ctx:               ctx,
 		rowType:           rowType,
+		compressionCodec:  compressionCodec,
+		flushSlots:        make(chan struct{}, maxConcurrentFlushes),
 	}
 
 	go func() {
+		defer close(w.stopped)
+
 		for {
 			select {
 			case <-w.done:
@@ -90,38 +277,148 @@ func NewParquetWriter(ctx context.Context, logger hclog.Logger, svc S3API, buffe
 	return w, nil
 }
 
-func (w *ParquetWriter) getParquetWriter(datehour string) (*writer.ParquetWriter, error) {
-	if w.parquetWriterRefs[datehour] != nil {
-		return w.parquetWriterRefs[datehour].parquetWriter, nil
+func (w *ParquetWriter) getParquetWriter(partition string) (*ParquetRef, error) {
+	if w.parquetWriterRefs[partition] != nil {
+		return w.parquetWriterRefs[partition], nil
 	}
 
-	writeFile, err := s3v2.NewS3FileWriterWithClient(w.ctx, w.svc, w.bucketName, w.parquetKey(datehour), nil)
+	writeFile, err := w.sink.CreateFile(w.ctx, w.parquetKey(partition))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create parquet s3 client: %w", err)
+		return nil, fmt.Errorf("failed to create parquet file: %w", err)
 	}
 
-	parquetWriter, err := writer.NewParquetWriter(writeFile, w.rowType, PARQUET_CONCURRENCY)
+	parquetWriter, err := w.newParquetWriter(writeFile)
 	if err != nil {
-		writeFile.Close()
+		if abortErr := w.abortParquetFile(writeFile); abortErr != nil {
+			w.logger.Error("failed to abort parquet file", "error", abortErr)
+		}
+
 		return nil, fmt.Errorf("failed to create parquet writer: %w", err)
 	}
+	parquetWriter.CompressionType = w.compressionCodec
+	parquetWriter.RowGroupSize = w.opts.RowGroupSize
+	parquetWriter.PageSize = w.opts.PageSize
 
-	w.parquetWriterRefs[datehour] = &ParquetRef{
+	parquetRef := &ParquetRef{
 		parquetWriteFile: writeFile,
 		parquetWriter:    parquetWriter,
 	}
+	w.parquetWriterRefs[partition] = parquetRef
+
+	return parquetRef, nil
+}
+
+func (w *ParquetWriter) newParquetWriter(writeFile source.ParquetFile) (*writer.ParquetWriter, error) {
+	parquetSchema, ok := w.rowType.(ParquetSchema)
+	if !ok {
+		return writer.NewParquetWriter(writeFile, w.rowType, w.opts.Concurrency)
+	}
+
+	schemaHandler, err := parquetSchema.SchemaHandler()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create schema: %w", err)
+	}
+
+	parquetWriter, err := writer.NewParquetWriter(writeFile, nil, w.opts.Concurrency)
+	if err != nil {
+		return nil, err
+	}
+	parquetWriter.SchemaHandler = schemaHandler
+	parquetWriter.Footer.Schema = append(parquetWriter.Footer.Schema, schemaHandler.SchemaElements...)
+	parquetWriter.MarshalFunc = parquetSchema.Marshal
 
 	return parquetWriter, nil
 }
 
-func (w *ParquetWriter) parquetKey(datehour string) string {
-	return S3ParquetKey(w.prefix, RandStringBytes(32), datehour)
+// parquetKey returns the key of the next file, must be called while holding the buffer mutex
+func (w *ParquetWriter) parquetKey(partition string) string {
+	key := S3ParquetKey(w.prefix, ParquetFileName(w.opts.InstanceID, w.startTime, w.sequence), partition)
+	w.sequence++
+
+	return key
 }
 
 func (w *ParquetWriter) closeParquetWriter(parquetRef *ParquetRef) error {
+	if w.opts.OnFileClosed != nil {
+		defer w.opts.OnFileClosed(parquetRef.bytes)
+	}
+
+	w.flushSlots <- struct{}{}
+	defer func() { <-w.flushSlots }()
+
+	rows := parquetRef.rows
+	if spillableFile, ok := parquetRef.parquetWriteFile.(SpillableParquetFile); ok {
+		spillableFile.OnUploaded(func() {
+			w.updateStats(func(stats *FlushStats) {
+				stats.FilesSpilled--
+				stats.RowsSpilled -= rows
+				stats.FilesFlushed++
+				stats.RowsFlushed += rows
+			})
+		})
+	}
+
+	start := time.Now()
+	if err := w.flushParquetWriter(parquetRef); err != nil {
+		// Spilled files are uploaded later, so they are neither flushed nor failed
+		if errors.Is(err, errParquetFileSpilled) {
+			w.updateStats(func(stats *FlushStats) {
+				stats.FilesSpilled++
+				stats.RowsSpilled += rows
+			})
+			return nil
+		}
+
+		w.metrics.FlushErrors.Inc(1)
+		w.updateStats(func(stats *FlushStats) {
+			stats.FilesFailed++
+		})
+		return err
+	}
+
+	w.metrics.FlushDuration.Record(time.Since(start))
+	w.metrics.FilesFlushed.Inc(1)
+	w.updateStats(func(stats *FlushStats) {
+		stats.FilesFlushed++
+		stats.RowsFlushed += parquetRef.rows
+	})
+
+	return nil
+}
+
+func (w *ParquetWriter) updateStats(update func(stats *FlushStats)) {
+	w.statsMutex.Lock()
+	defer w.statsMutex.Unlock()
+
+	update(&w.stats)
+}
+
+func (w *ParquetWriter) FlushStats() FlushStats {
+	w.statsMutex.Lock()
+	defer w.statsMutex.Unlock()
+
+	return w.stats
+}
+
+// flushParquetWriter writes the parquet footer and completes the upload. Files failing to be
+// completed are cleaned up by the file itself, so partially written files never linger.
+func (w *ParquetWriter) flushParquetWriter(parquetRef *ParquetRef) error {
 	if parquetRef.parquetWriter != nil {
-		if err := parquetRef.parquetWriter.WriteStop(); err != nil {
-			return fmt.Errorf("parquet write stop error: %w", err)
+		err := w.writeSortedRows(parquetRef)
+		if err == nil {
+			if err = parquetRef.parquetWriter.WriteStop(); err != nil {
+				err = fmt.Errorf("parquet write stop error: %w", err)
+			}
+		}
+
+		if err != nil {
+			if parquetRef.parquetWriteFile != nil {
+				if abortErr := w.abortParquetFile(parquetRef.parquetWriteFile); abortErr != nil {
+					err = errors.Join(err, abortErr)
+				}
+			}
+
+			return err
 		}
 	}
 
@@ -134,6 +431,49 @@ func (w *ParquetWriter) closeParquetWriter(parquetRef *ParquetRef) error {
 	return nil
 }
 
+// writeSortedRows writes the rows buffered for sorting into the parquet file
+func (w *ParquetWriter) writeSortedRows(parquetRef *ParquetRef) error {
+	sort.SliceStable(parquetRef.sortedRows, func(i, j int) bool {
+		return lessSortableRow(parquetRef.sortedRows[i], parquetRef.sortedRows[j])
+	})
+
+	for i, row := range parquetRef.sortedRows {
+		if err := parquetRef.parquetWriter.Write(row); err != nil {
+			return fmt.Errorf("failed to write row: %w", err)
+		}
+		parquetRef.sortedRows[i] = nil
+	}
+	parquetRef.sortedRows = nil
+
+	return nil
+}
+
+func lessSortableRow(a interface{}, b interface{}) bool {
+	sortableA, okA := a.(SortableRow)
+	sortableB, okB := b.(SortableRow)
+	if !okA || !okB {
+		return false
+	}
+
+	primaryA, secondaryA := sortableA.SortKey()
+	primaryB, secondaryB := sortableB.SortKey()
+	if primaryA != primaryB {
+		return primaryA < primaryB
+	}
+
+	return secondaryA < secondaryB
+}
+
+func (w *ParquetWriter) abortParquetFile(file source.ParquetFile) error {
+	w.metrics.FilesAborted.Inc(1)
+
+	if abortableFile, ok := file.(AbortableParquetFile); ok {
+		return abortableFile.Abort()
+	}
+
+	return file.Close()
+}
+
 func (w *ParquetWriter) rotateParquetWriters() error {
 	w.bufferMutex.Lock()
 
@@ -151,43 +491,117 @@ func (w *ParquetWriter) rotateParquetWriters() error {
 	return w.closeParquetWriters(writerRefs)
 }
 
+// closeParquetWriters closes all writers concurrently, a failing writer doesn't prevent others from being closed
 func (w *ParquetWriter) closeParquetWriters(parquetWriterRefs map[string]*ParquetRef) error {
-	for _, writerRef := range parquetWriterRefs {
-		if err := w.closeParquetWriter(writerRef); err != nil {
-			return fmt.Errorf("failed to close previous parquet writer: %w", err)
-		}
+	var wg sync.WaitGroup
+	errs := make([]error, 0, len(parquetWriterRefs))
+	var errsMutex sync.Mutex
+
+	for partition, writerRef := range parquetWriterRefs {
+		wg.Add(1)
+		go func(partition string, writerRef *ParquetRef) {
+			defer wg.Done()
+
+			if err := w.closeParquetWriter(writerRef); err != nil {
+				errsMutex.Lock()
+				errs = append(errs, fmt.Errorf("failed to close parquet writer for %s: %w", partition, err))
+				errsMutex.Unlock()
+			}
+		}(partition, writerRef)
 	}
 
-	return nil
+	wg.Wait()
+
+	return errors.Join(errs...)
 }
 
 func (w *ParquetWriter) Write(ctx context.Context, time time.Time, maxBufferUntil time.Time, row interface{}) error {
+	rotatedRef, err := w.write(time, maxBufferUntil, row)
+	if err != nil {
+		return err
+	}
+
+	if rotatedRef != nil {
+		w.closeRotatedParquetWriter(rotatedRef)
+	}
+
+	return nil
+}
+
+// write writes the row and returns the parquet writer, when it crossed a rotation threshold. The returned
+// writer is already added to the rotated writers and must be closed using closeRotatedParquetWriter.
+func (w *ParquetWriter) write(time time.Time, maxBufferUntil time.Time, row interface{}) (*ParquetRef, error) {
 	w.bufferMutex.Lock()
 	defer w.bufferMutex.Unlock()
 
+	if w.closed {
+		return nil, ErrParquetWriterClosed
+	}
+
 	if w.bufferMaxUntil == nil || w.bufferMaxUntil.After(maxBufferUntil) {
 		w.bufferMaxUntil = &maxBufferUntil
 	}
 
-	spanDatehour := S3PartitionKey(time)
+	partition := w.opts.Partitions.Path(time, row)
 
-	parquetWriter, err := w.getParquetWriter(spanDatehour)
+	parquetRef, err := w.getParquetWriter(partition)
 	if err != nil {
-		return fmt.Errorf("failed to get parquet writer: %w", err)
+		return nil, fmt.Errorf("failed to get parquet writer: %w", err)
 	}
 
-	if err := parquetWriter.Write(row); err != nil {
-		return fmt.Errorf("failed to write row: %w", err)
+	if w.opts.SortRows {
+		parquetRef.sortedRows = append(parquetRef.sortedRows, row)
+	} else if err := parquetRef.parquetWriter.Write(row); err != nil {
+		return nil, fmt.Errorf("failed to write row: %w", err)
 	}
-	return nil
+	w.metrics.RowsWritten.Inc(1)
+	w.updateStats(func(stats *FlushStats) {
+		stats.RowsWritten++
+	})
+
+	parquetRef.rows++
+	parquetRef.bytes += approximateRowSize(row)
+
+	if (w.opts.MaxFileRows > 0 && parquetRef.rows >= w.opts.MaxFileRows) ||
+		(w.opts.MaxFileBytes > 0 && parquetRef.bytes >= w.opts.MaxFileBytes) {
+		delete(w.parquetWriterRefs, partition)
+		w.rotatedParquetWriters.Add(1)
+		return parquetRef, nil
+	}
+
+	return nil, nil
 }
 
+// closeRotatedParquetWriter closes a parquet writer, which crossed a rotation threshold, without blocking writes
+func (w *ParquetWriter) closeRotatedParquetWriter(parquetRef *ParquetRef) {
+	w.logger.Debug("rotating parquet writer", "prefix", w.prefix, "rows", parquetRef.rows, "bytes", parquetRef.bytes)
+
+	go func() {
+		defer w.rotatedParquetWriters.Done()
+
+		if err := w.closeParquetWriter(parquetRef); err != nil {
+			w.logger.Error("failed to close rotated parquet writer", "error", err)
+		}
+	}()
+}
+
+// Close flushes all open files, including files of a rotation in progress. Rows written after Close
+// are rejected with ErrParquetWriterClosed. It is safe to call Close multiple times, subsequent calls
+// return the result of the first call.
 func (w *ParquetWriter) Close() error {
-	w.ticker.Stop()
-	w.done <- true
+	w.closeOnce.Do(func() {
+		w.ticker.Stop()
+		close(w.done)
+		<-w.stopped
 
-	w.bufferMutex.Lock()
-	defer w.bufferMutex.Unlock()
+		w.bufferMutex.Lock()
+		defer w.bufferMutex.Unlock()
+
+		w.closed = true
+		w.closeErr = w.closeParquetWriters(w.parquetWriterRefs)
+		w.parquetWriterRefs = map[string]*ParquetRef{}
+		w.rotatedParquetWriters.Wait()
+	})
 
-	return w.closeParquetWriters(w.parquetWriterRefs)
+	return w.closeErr
 }
@@ -2,33 +2,51 @@ package s3spanstore
 
 import (
 	"context"
+	"errors"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/golang/mock/gomock"
 	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
 	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore/mocks"
 	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-lib/metrics"
+	"github.com/uber/jaeger-lib/metrics/metricstest"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
 )
 
-func NewTestParquetWriter(ctx context.Context, assert *assert.Assertions, mockSvc *mocks.MockS3API) *ParquetWriter {
-	loggerName := "jaeger-s3"
-
+func NewTestParquetWriterLogger() hclog.Logger {
 	logLevel := os.Getenv("GRPC_STORAGE_PLUGIN_LOG_LEVEL")
 	if logLevel == "" {
 		logLevel = hclog.Debug.String()
 	}
 
-	logger := hclog.New(&hclog.LoggerOptions{
+	return hclog.New(&hclog.LoggerOptions{
 		Level:      hclog.LevelFromString(logLevel),
-		Name:       loggerName,
+		Name:       "jaeger-s3",
 		JSONFormat: true,
 	})
+}
 
-	writer, err := NewParquetWriter(ctx, logger, mockSvc, time.Millisecond*200, "jaeger-spans", "/spans/", new(SpanRecord))
+// NewTestParquetWriterWithSink creates a span writer writing files into sink
+func NewTestParquetWriterWithSink(ctx context.Context, metricsFactory metrics.Factory, sink ParquetFileSink, opts ParquetWriterOptions) (*ParquetWriter, error) {
+	return NewParquetWriter(ctx, NewTestParquetWriterLogger(), metricsFactory, sink, "spans/", new(SpanRecord), opts)
+}
 
+func NewTestParquetWriter(ctx context.Context, assert *assert.Assertions, mockSvc *mocks.MockS3API) *ParquetWriter {
+	writer, err := NewTestParquetWriterWithSink(ctx, metrics.NullFactory, NewS3ParquetFileSink(mockSvc, "jaeger-spans"), ParquetWriterOptions{BufferDuration: time.Millisecond * 200})
 	assert.NoError(err)
 
 	return writer
@@ -49,7 +67,7 @@ func TestWriteSpanAndRotate(t *testing.T) {
 
 	span := NewTestSpan(assert)
 
-	spanRecord, err := NewSpanRecordFromSpan(span)
+	spanRecord, err := NewSpanRecordFromSpan(span, nil)
 	assert.NoError(err)
 
 	assert.NoError(writer.Write(ctx, span.StartTime, span.StartTime, spanRecord))
@@ -76,7 +94,7 @@ func TestWriteSpanWithLargeBufferUntilAndRotate(t *testing.T) {
 
 	span := NewTestSpan(assert)
 
-	spanRecord, err := NewSpanRecordFromSpan(span)
+	spanRecord, err := NewSpanRecordFromSpan(span, nil)
 	assert.NoError(err)
 
 	assert.NoError(writer.Write(ctx, span.StartTime, time.Now().Add(time.Millisecond*500), spanRecord))
@@ -87,3 +105,541 @@ func TestWriteSpanWithLargeBufferUntilAndRotate(t *testing.T) {
 
 	assert.NoError(writer.Close())
 }
+
+func TestWriteSpanToLocalDirectory(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	directory := t.TempDir()
+
+	writer, err := NewTestParquetWriterWithSink(ctx, metrics.NullFactory, NewLocalParquetFileSink(directory), ParquetWriterOptions{BufferDuration: time.Hour})
+	assert.NoError(err)
+
+	span := NewTestSpan(assert)
+
+	spanRecord, err := NewSpanRecordFromSpan(span, nil)
+	assert.NoError(err)
+
+	assert.NoError(writer.Write(ctx, span.StartTime, span.StartTime, spanRecord))
+	assert.NoError(writer.Close())
+
+	files, err := filepath.Glob(filepath.Join(directory, "spans", "2017", "01", "26", "16", "*"))
+	assert.NoError(err)
+	assert.Len(files, 1)
+	assert.True(strings.HasSuffix(files[0], ".parquet"))
+
+	localFileReader, err := local.NewLocalFileReader(files[0])
+	assert.NoError(err)
+	pr, err := reader.NewParquetReader(localFileReader, new(SpanRecord), 1)
+	assert.NoError(err)
+
+	assert.Equal(1, int(pr.GetNumRows()))
+
+	pr.ReadStop()
+	assert.NoError(localFileReader.Close())
+}
+
+func TestParquetWriterMetrics(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	metricsFactory := metricstest.NewFactory(0)
+	defer metricsFactory.Stop()
+
+	writer, err := NewTestParquetWriterWithSink(ctx, parquetWriterMetricsFactory(metricsFactory, "spans"), NewLocalParquetFileSink(t.TempDir()), ParquetWriterOptions{BufferDuration: time.Hour})
+	assert.NoError(err)
+
+	span := NewTestSpan(assert)
+
+	spanRecord, err := NewSpanRecordFromSpan(span, nil)
+	assert.NoError(err)
+
+	assert.NoError(writer.Write(ctx, span.StartTime, span.StartTime, spanRecord))
+	assert.NoError(writer.Write(ctx, span.StartTime, span.StartTime, spanRecord))
+	assert.NoError(writer.Close())
+
+	tags := map[string]string{"kind": "spans"}
+	metricsFactory.AssertCounterMetrics(t,
+		metricstest.ExpectedMetric{Name: "parquet_rows_written", Tags: tags, Value: 2},
+		metricstest.ExpectedMetric{Name: "parquet_files_flushed", Tags: tags, Value: 1},
+		metricstest.ExpectedMetric{Name: "parquet_flush_errors", Tags: tags, Value: 0},
+	)
+}
+
+func TestLocalParquetFileSinkEmpty(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	directory := t.TempDir()
+	assert.NoError(os.MkdirAll(filepath.Join(directory, "spans", "2017"), 0755))
+	assert.NoError(os.WriteFile(filepath.Join(directory, "spans", "2017", "test.parquet"), []byte{}, 0644))
+
+	sink := NewLocalParquetFileSink(directory)
+	assert.NoError(sink.Empty(ctx))
+
+	entries, err := os.ReadDir(directory)
+	assert.NoError(err)
+	assert.Empty(entries)
+
+	assert.NoError(NewLocalParquetFileSink(filepath.Join(directory, "missing")).Empty(ctx))
+}
+
+func TestParquetWriterRotation(t *testing.T) {
+	span := NewTestSpan(assert.New(t))
+	spanRecord, err := NewSpanRecordFromSpan(span, nil)
+	assert.NoError(t, err)
+
+	rowBytes := common.SizeOf(reflect.ValueOf(spanRecord))
+
+	tests := []struct {
+		name string
+		opts ParquetWriterOptions
+	}{
+		{name: "max file rows", opts: ParquetWriterOptions{BufferDuration: time.Hour, MaxFileRows: 2}},
+		{name: "max file bytes", opts: ParquetWriterOptions{BufferDuration: time.Hour, MaxFileBytes: rowBytes + 1}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			ctx := context.TODO()
+
+			directory := t.TempDir()
+			partitionFiles := filepath.Join(directory, "spans", "2017", "01", "26", "16", "*.parquet")
+
+			writer, err := NewTestParquetWriterWithSink(ctx, metrics.NullFactory, NewLocalParquetFileSink(directory), tt.opts)
+			assert.NoError(err)
+
+			// The first row stays below the threshold
+			assert.NoError(writer.Write(ctx, span.StartTime, span.StartTime, spanRecord))
+			files, err := filepath.Glob(partitionFiles)
+			assert.NoError(err)
+			assert.Empty(files)
+
+			// The second row crosses the threshold and the file is flushed, before the buffer duration elapsed
+			assert.NoError(writer.Write(ctx, span.StartTime, span.StartTime, spanRecord))
+			assert.Eventually(func() bool {
+				files, err := filepath.Glob(partitionFiles)
+				return err == nil && len(files) == 1
+			}, time.Second, 10*time.Millisecond)
+
+			// Following rows are written into a new file
+			assert.NoError(writer.Write(ctx, span.StartTime, span.StartTime, spanRecord))
+			assert.NoError(writer.Close())
+
+			files, err = filepath.Glob(partitionFiles)
+			assert.NoError(err)
+			assert.Len(files, 2)
+		})
+	}
+}
+
+// failingParquetFileSink creates files failing to close for keys containing failingKey
+type failingParquetFileSink struct {
+	ParquetFileSink
+	failingKey string
+}
+
+type failingParquetFile struct {
+	AbortableParquetFile
+}
+
+func (f *failingParquetFile) Close() error {
+	if err := f.AbortableParquetFile.Abort(); err != nil {
+		return err
+	}
+
+	return errors.New("close failed")
+}
+
+func (s *failingParquetFileSink) CreateFile(ctx context.Context, key string) (source.ParquetFile, error) {
+	file, err := s.ParquetFileSink.CreateFile(ctx, key)
+	if err != nil || !strings.Contains(key, s.failingKey) {
+		return file, err
+	}
+
+	return &failingParquetFile{AbortableParquetFile: file.(AbortableParquetFile)}, nil
+}
+
+func TestParquetWriterClosesRemainingFilesAfterFailure(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	span := NewTestSpan(assert)
+	spanRecord, err := NewSpanRecordFromSpan(span, nil)
+	assert.NoError(err)
+
+	directory := t.TempDir()
+	sink := &failingParquetFileSink{ParquetFileSink: NewLocalParquetFileSink(directory), failingKey: "/16/"}
+
+	metricsFactory := metricstest.NewFactory(0)
+	writer, err := NewTestParquetWriterWithSink(ctx, metricsFactory, sink, ParquetWriterOptions{BufferDuration: time.Hour})
+	assert.NoError(err)
+
+	for _, hour := range []time.Duration{-time.Hour, 0, time.Hour} {
+		startTime := span.StartTime.Add(hour)
+		assert.NoError(writer.Write(ctx, startTime, startTime, spanRecord))
+	}
+
+	err = writer.Close()
+	assert.Error(err)
+	assert.Contains(err.Error(), "2017/01/26/16")
+	assert.Contains(err.Error(), "close failed")
+
+	// Files of other partitions are still written
+	for hour, expectedFiles := range map[string]int{"15": 1, "16": 0, "17": 1} {
+		files, err := filepath.Glob(filepath.Join(directory, "spans", "2017", "01", "26", hour, "*"))
+		assert.NoError(err)
+		assert.Len(files, expectedFiles, hour)
+	}
+
+	metricsFactory.AssertCounterMetrics(t,
+		metricstest.ExpectedMetric{Name: "parquet_files_flushed", Value: 2},
+		metricstest.ExpectedMetric{Name: "parquet_flush_errors", Value: 1},
+	)
+}
+
+func TestParquetWriterCloseTwice(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	span := NewTestSpan(assert)
+	spanRecord, err := NewSpanRecordFromSpan(span, nil)
+	assert.NoError(err)
+
+	directory := t.TempDir()
+
+	writer, err := NewTestParquetWriterWithSink(ctx, metrics.NullFactory, NewLocalParquetFileSink(directory), ParquetWriterOptions{BufferDuration: time.Hour})
+	assert.NoError(err)
+
+	assert.NoError(writer.Write(ctx, span.StartTime, span.StartTime, spanRecord))
+	assert.NoError(writer.Write(ctx, span.StartTime, span.StartTime, spanRecord))
+	assert.Equal(FlushStats{RowsWritten: 2}, writer.FlushStats())
+
+	assert.NoError(writer.Close())
+	assert.NoError(writer.Close())
+
+	stats := writer.FlushStats()
+	assert.Equal(FlushStats{RowsWritten: 2, RowsFlushed: 2, FilesFlushed: 1}, stats)
+	assert.Equal(int64(0), stats.RowsUnflushed())
+
+	files, err := filepath.Glob(filepath.Join(directory, "spans", "2017", "01", "26", "16", "*.parquet"))
+	assert.NoError(err)
+	assert.Len(files, 1)
+}
+
+func TestParquetWriterWriteDuringClose(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	span := NewTestSpan(assert)
+	spanRecord, err := NewSpanRecordFromSpan(span, nil)
+	assert.NoError(err)
+
+	directory := t.TempDir()
+
+	writer, err := NewTestParquetWriterWithSink(ctx, metrics.NullFactory, NewLocalParquetFileSink(directory), ParquetWriterOptions{
+		BufferDuration: time.Hour,
+		MaxFileRows:    1,
+	})
+	assert.NoError(err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				if err := writer.Write(ctx, span.StartTime, span.StartTime, spanRecord); err != nil {
+					assert.ErrorIs(err, ErrParquetWriterClosed)
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	assert.NoError(writer.Close())
+	wg.Wait()
+
+	// Every accepted row was flushed, including rows of files rotated while closing
+	stats := writer.FlushStats()
+	assert.Greater(stats.RowsWritten, int64(0))
+	assert.Equal(int64(0), stats.RowsUnflushed())
+	assert.Equal(stats.RowsWritten, stats.FilesFlushed)
+}
+
+func TestParquetWriterSpilledFiles(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	span := NewTestSpan(assert)
+	spanRecord, err := NewSpanRecordFromSpan(span, nil)
+	assert.NoError(err)
+
+	// The retry blocks until the spilled file was checked
+	retry := make(chan struct{})
+	gomock.InOrder(
+		mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, errors.New("service unavailable")),
+		mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, _ *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			<-retry
+			return &s3.PutObjectOutput{}, nil
+		}),
+	)
+
+	sink := NewTestSpillParquetFileSink(assert, metrics.NullFactory, mockSvc, t.TempDir())
+
+	writer, err := NewTestParquetWriterWithSink(ctx, metrics.NullFactory, sink, ParquetWriterOptions{BufferDuration: time.Hour})
+	assert.NoError(err)
+
+	assert.NoError(writer.Write(ctx, span.StartTime, span.StartTime, spanRecord))
+	assert.NoError(writer.Write(ctx, span.StartTime, span.StartTime, spanRecord))
+	assert.NoError(writer.Close())
+
+	// Spilled files aren't reported as flushed
+	stats := writer.FlushStats()
+	assert.Equal(FlushStats{RowsWritten: 2, RowsSpilled: 2, FilesSpilled: 1}, stats)
+	assert.Equal(int64(0), stats.RowsUnflushed())
+
+	// Once uploaded in the background, the file is reported as flushed
+	close(retry)
+	assert.Eventually(func() bool {
+		return writer.FlushStats() == FlushStats{RowsWritten: 2, RowsFlushed: 2, FilesFlushed: 1}
+	}, time.Second, time.Millisecond)
+
+	assert.NoError(sink.Close())
+}
+
+func TestParquetWriterFileNames(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	span := NewTestSpan(assert)
+	spanRecord, err := NewSpanRecordFromSpan(span, nil)
+	assert.NoError(err)
+
+	directory := t.TempDir()
+
+	writer, err := NewTestParquetWriterWithSink(ctx, metrics.NullFactory, NewLocalParquetFileSink(directory), ParquetWriterOptions{
+		InstanceID:     "test-host",
+		BufferDuration: time.Hour,
+		MaxFileRows:    1,
+	})
+	assert.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(writer.Write(ctx, span.StartTime, span.StartTime, spanRecord))
+	}
+	assert.NoError(writer.Close())
+
+	files, err := filepath.Glob(filepath.Join(directory, "spans", "2017", "01", "26", "16", "*.parquet"))
+	assert.NoError(err)
+
+	start := writer.startTime.UTC().Format(PARQUET_FILE_TIME_FORMAT)
+	fileNames := []string{}
+	for _, file := range files {
+		fileNames = append(fileNames, filepath.Base(file))
+	}
+	assert.ElementsMatch([]string{
+		"test-host-" + start + "-000000.parquet",
+		"test-host-" + start + "-000001.parquet",
+		"test-host-" + start + "-000002.parquet",
+	}, fileNames)
+}
+
+func TestParquetWriterCompressionCodec(t *testing.T) {
+	tests := []struct {
+		codec    string
+		expected parquet.CompressionCodec
+	}{
+		{codec: "", expected: parquet.CompressionCodec_SNAPPY},
+		{codec: "snappy", expected: parquet.CompressionCodec_SNAPPY},
+		{codec: "zstd", expected: parquet.CompressionCodec_ZSTD},
+		{codec: "gzip", expected: parquet.CompressionCodec_GZIP},
+		{codec: "none", expected: parquet.CompressionCodec_UNCOMPRESSED},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.codec, func(t *testing.T) {
+			assert := assert.New(t)
+			ctx := context.TODO()
+
+			directory := t.TempDir()
+
+			writer, err := NewTestParquetWriterWithSink(ctx, metrics.NullFactory, NewLocalParquetFileSink(directory), ParquetWriterOptions{
+				BufferDuration:   time.Hour,
+				CompressionCodec: tt.codec,
+				RowGroupSize:     1024 * 1024,
+				PageSize:         4 * 1024,
+				Concurrency:      2,
+			})
+			assert.NoError(err)
+
+			span := NewTestSpan(assert)
+			spanRecord, err := NewSpanRecordFromSpan(span, nil)
+			assert.NoError(err)
+
+			assert.NoError(writer.Write(ctx, span.StartTime, span.StartTime, spanRecord))
+			assert.NoError(writer.Close())
+
+			files, err := filepath.Glob(filepath.Join(directory, "spans", "2017", "01", "26", "16", "*.parquet"))
+			assert.NoError(err)
+			assert.Len(files, 1)
+
+			localFileReader, err := local.NewLocalFileReader(files[0])
+			assert.NoError(err)
+			pr, err := reader.NewParquetReader(localFileReader, new(SpanRecord), 1)
+			assert.NoError(err)
+
+			assert.Equal(1, int(pr.GetNumRows()))
+			for _, column := range pr.Footer.RowGroups[0].Columns {
+				assert.Equal(tt.expected, column.MetaData.Codec)
+			}
+
+			pr.ReadStop()
+			assert.NoError(localFileReader.Close())
+		})
+	}
+}
+
+func TestParquetWriterUnknownCompressionCodec(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewTestParquetWriterWithSink(context.TODO(), metrics.NullFactory, NewLocalParquetFileSink(t.TempDir()), ParquetWriterOptions{
+		BufferDuration:   time.Hour,
+		CompressionCodec: "lzo",
+	})
+	assert.Error(err)
+}
+
+// BenchmarkParquetWriterCompression compares the CPU time and the size of files written
+// using the supported compression codecs, e.g. go test -run=^$ -bench=ParquetWriterCompression
+func BenchmarkParquetWriterCompression(b *testing.B) {
+	assert := assert.New(b)
+	ctx := context.TODO()
+
+	span := NewTestSpanWithTagsAndReferences(assert)
+	spanRecord, err := NewSpanRecordFromSpan(span, nil)
+	assert.NoError(err)
+
+	rowsPerFile := 10000
+
+	for _, codec := range []string{"none", "snappy", "zstd", "gzip"} {
+		b.Run(codec, func(b *testing.B) {
+			directory := b.TempDir()
+
+			writer, err := NewTestParquetWriterWithSink(ctx, metrics.NullFactory, NewLocalParquetFileSink(directory), ParquetWriterOptions{
+				BufferDuration:   time.Hour,
+				MaxFileRows:      int64(rowsPerFile),
+				CompressionCodec: codec,
+			})
+			assert.NoError(err)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < rowsPerFile; j++ {
+					assert.NoError(writer.Write(ctx, span.StartTime, span.StartTime, spanRecord))
+				}
+			}
+			assert.NoError(writer.Close())
+
+			b.StopTimer()
+
+			files, err := filepath.Glob(filepath.Join(directory, "spans", "*", "*", "*", "*", "*.parquet"))
+			assert.NoError(err)
+
+			var size int64
+			for _, file := range files {
+				info, err := os.Stat(file)
+				assert.NoError(err)
+				size += info.Size()
+			}
+			b.ReportMetric(float64(size)/float64(len(files)), "bytes/file")
+		})
+	}
+}
+
+func TestParquetWriterSortRows(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	directory := t.TempDir()
+
+	writer, err := NewTestParquetWriterWithSink(ctx, metrics.NullFactory, NewLocalParquetFileSink(directory), ParquetWriterOptions{
+		BufferDuration: time.Hour,
+		RowGroupSize:   16 * 1024,
+		PageSize:       1024,
+		SortRows:       true,
+	})
+	assert.NoError(err)
+
+	span := NewTestSpan(assert)
+	spanCount := 500
+	for i := 0; i < spanCount; i++ {
+		// Write trace ids in descending order
+		span.TraceID = model.NewTraceID(1, uint64(spanCount-i))
+
+		spanRecord, err := NewSpanRecordFromSpan(span, nil)
+		assert.NoError(err)
+		assert.NoError(writer.Write(ctx, span.StartTime, span.StartTime, spanRecord))
+	}
+	assert.NoError(writer.Close())
+
+	files, err := filepath.Glob(filepath.Join(directory, "spans", "2017", "01", "26", "16", "*.parquet"))
+	assert.NoError(err)
+	assert.Len(files, 1)
+
+	localFileReader, err := local.NewLocalFileReader(files[0])
+	assert.NoError(err)
+	pr, err := reader.NewParquetReader(localFileReader, new(SpanRecord), 1)
+	assert.NoError(err)
+
+	rows := make([]SpanRecord, spanCount)
+	assert.NoError(pr.Read(&rows))
+
+	traceIDs := make([]string, len(rows))
+	for i, row := range rows {
+		traceIDs[i] = row.TraceID
+	}
+	assert.True(sort.StringsAreSorted(traceIDs))
+
+	// Sorted row groups don't overlap, so lookups can skip row groups using the statistics
+	assert.Greater(len(pr.Footer.RowGroups), 1)
+	for i := 1; i < len(pr.Footer.RowGroups); i++ {
+		previous := pr.Footer.RowGroups[i-1].Columns[0].MetaData.Statistics
+		current := pr.Footer.RowGroups[i].Columns[0].MetaData.Statistics
+		assert.Less(string(previous.MaxValue), string(current.MinValue))
+	}
+
+	pr.ReadStop()
+	assert.NoError(localFileReader.Close())
+}
+
+func TestParquetWriterSortRowsRowGroupSize(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	writer, err := NewTestParquetWriterWithSink(ctx, metrics.NullFactory, NewLocalParquetFileSink(t.TempDir()), ParquetWriterOptions{
+		BufferDuration: time.Hour,
+		SortRows:       true,
+	})
+	assert.NoError(err)
+	assert.Equal(defaultSortedRowGroupSize, writer.opts.RowGroupSize)
+	assert.NoError(writer.Close())
+
+	_, err = NewTestParquetWriterWithSink(ctx, metrics.NullFactory, NewLocalParquetFileSink(t.TempDir()), ParquetWriterOptions{
+		BufferDuration: time.Hour,
+		RowGroupSize:   defaultRowGroupSize,
+		SortRows:       true,
+	})
+	assert.ErrorContains(err, "row group size")
+}
@@ -0,0 +1,259 @@
+package s3spanstore
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+)
+
+// PartitionGranularity controls the time range covered by a single datehour partition
+type PartitionGranularity string
+
+const (
+	PartitionGranularityHour           PartitionGranularity = "hour"
+	PartitionGranularityDay            PartitionGranularity = "day"
+	PartitionGranularityFifteenMinutes PartitionGranularity = "15m"
+)
+
+// Characters of service names, which aren't safe to be used as partition value are replaced
+var unsafeServicePartitionCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// OtherServicePartition contains the files of all services, which aren't enumerated by the
+// service partition projection. Queries scoped to a service always include it.
+const OtherServicePartition = "_other"
+
+type partitionLayout struct {
+	// format of the partition key as go time layout
+	format string
+	// truncate is applied before formatting, for granularities the layout can't express
+	truncate time.Duration
+
+	// Athena partition projection parameters, see
+	// https://docs.aws.amazon.com/athena/latest/ug/partition-projection-supported-types.html#partition-projection-date-type
+	projectionFormat       string
+	projectionRangeStart   string
+	projectionInterval     string
+	projectionIntervalUnit string
+}
+
+var partitionLayouts = map[PartitionGranularity]partitionLayout{
+	PartitionGranularityHour: {
+		format:                 "2006/01/02/15",
+		projectionFormat:       "yyyy/MM/dd/HH",
+		projectionRangeStart:   "2022/01/01/00",
+		projectionInterval:     "1",
+		projectionIntervalUnit: "HOURS",
+	},
+	PartitionGranularityDay: {
+		format:                 "2006/01/02",
+		projectionFormat:       "yyyy/MM/dd",
+		projectionRangeStart:   "2022/01/01",
+		projectionInterval:     "1",
+		projectionIntervalUnit: "DAYS",
+	},
+	PartitionGranularityFifteenMinutes: {
+		format:                 "2006/01/02/15/04",
+		truncate:               15 * time.Minute,
+		projectionFormat:       "yyyy/MM/dd/HH/mm",
+		projectionRangeStart:   "2022/01/01/00/00",
+		projectionInterval:     "15",
+		projectionIntervalUnit: "MINUTES",
+	},
+}
+
+// PartitionScheme maps span times to the datehour partition of the parquet files and optionally
+// service names to a second service_partition level below. The scheme used by the writers, the
+// reader conditions and the table partition projection must match. The zero value uses hourly
+// partitions without service partitions.
+type PartitionScheme struct {
+	granularity PartitionGranularity
+	serviceName bool
+	// serviceKeys are the enumerated service partitions, other services are written into
+	// OtherServicePartition
+	serviceKeys map[string]bool
+}
+
+// ServicePartitionedRow is written into the service partition of its service
+type ServicePartitionedRow interface {
+	PartitionServiceName() string
+}
+
+func NewPartitionScheme(cfg config.Partitioning) (PartitionScheme, error) {
+	granularity := PartitionGranularity(cfg.Granularity)
+	if granularity == "" {
+		granularity = PartitionGranularityHour
+	}
+
+	if _, ok := partitionLayouts[granularity]; !ok {
+		return PartitionScheme{}, fmt.Errorf("unknown partition granularity %q", cfg.Granularity)
+	}
+
+	if !cfg.ServiceName {
+		return PartitionScheme{granularity: granularity}, nil
+	}
+
+	if len(cfg.ServiceNames) == 0 {
+		return PartitionScheme{}, fmt.Errorf("service names are required to partition by service name")
+	}
+
+	serviceKeys := make(map[string]bool, len(cfg.ServiceNames))
+	for _, serviceName := range cfg.ServiceNames {
+		serviceKeys[servicePartitionKey(serviceName)] = true
+	}
+
+	return PartitionScheme{granularity: granularity, serviceName: true, serviceKeys: serviceKeys}, nil
+}
+
+// ServiceNamePartitioned reports whether files are partitioned by service name
+func (s PartitionScheme) ServiceNamePartitioned() bool {
+	return s.serviceName
+}
+
+// WithoutServiceName returns the scheme without the service partition level
+func (s PartitionScheme) WithoutServiceName() PartitionScheme {
+	s.serviceName = false
+	s.serviceKeys = nil
+	return s
+}
+
+// ServiceListed reports whether a service has its own service partition. Spans of other services
+// are written into OtherServicePartition.
+func (s PartitionScheme) ServiceListed(serviceName string) bool {
+	return s.serviceKeys[servicePartitionKey(serviceName)]
+}
+
+func (s PartitionScheme) Granularity() PartitionGranularity {
+	if s.granularity == "" {
+		return PartitionGranularityHour
+	}
+
+	return s.granularity
+}
+
+func (s PartitionScheme) layout() partitionLayout {
+	return partitionLayouts[s.Granularity()]
+}
+
+// Key returns the datehour partition containing t, e.g. 2021/01/30/06 for hourly partitions
+func (s PartitionScheme) Key(t time.Time) string {
+	layout := s.layout()
+	if layout.truncate > 0 {
+		t = t.Truncate(layout.truncate)
+	}
+
+	return t.Format(layout.format)
+}
+
+// ServiceKey returns the service partition of a service name. Unsafe characters are replaced, so
+// multiple services can share a partition, which is fine as queries still filter on service_name.
+// Services not listed in the configured service names share OtherServicePartition.
+func (s PartitionScheme) ServiceKey(serviceName string) string {
+	key := servicePartitionKey(serviceName)
+	if !s.serviceKeys[key] {
+		return OtherServicePartition
+	}
+
+	return key
+}
+
+func servicePartitionKey(serviceName string) string {
+	key := unsafeServicePartitionCharacters.ReplaceAllString(serviceName, "_")
+	if key == "" {
+		return "_"
+	}
+
+	return key
+}
+
+// Path returns the partition path of a row, e.g. 2021/01/30/06/frontend with service partitions
+func (s PartitionScheme) Path(t time.Time, row interface{}) string {
+	path := s.Key(t)
+	if !s.serviceName {
+		return path
+	}
+
+	serviceName := ""
+	if partitionedRow, ok := row.(ServicePartitionedRow); ok {
+		serviceName = partitionedRow.PartitionServiceName()
+	}
+
+	return path + "/" + s.ServiceKey(serviceName)
+}
+
+// ServiceCondition restricts a query to the service partition of a service, it is empty
+// without service partitions. OtherServicePartition is always included, as it still contains
+// the files of services written before they were added to the service names.
+func (s PartitionScheme) ServiceCondition(serviceName string) string {
+	if !s.serviceName {
+		return ""
+	}
+
+	key := s.ServiceKey(serviceName)
+	if key == OtherServicePartition {
+		return fmt.Sprintf(`service_partition = %s`, sqlString(OtherServicePartition))
+	}
+
+	return fmt.Sprintf(`service_partition IN (%s, %s)`, sqlString(key), sqlString(OtherServicePartition))
+}
+
+// Condition restricts a query to the partitions between min and max (inclusive)
+func (s PartitionScheme) Condition(min time.Time, max time.Time) string {
+	return fmt.Sprintf(`datehour BETWEEN '%s' AND '%s'`, s.Key(min), s.Key(max))
+}
+
+// PartitionColumns returns the partition columns of the tables in path order
+func (s PartitionScheme) PartitionColumns() []string {
+	if s.serviceName {
+		return []string{"datehour", "service_partition"}
+	}
+
+	return []string{"datehour"}
+}
+
+// LocationTemplate returns the storage location template of a table stored below location
+func (s PartitionScheme) LocationTemplate(location string) string {
+	template := location + "${datehour}/"
+	if s.serviceName {
+		template += "${service_partition}/"
+	}
+
+	return template
+}
+
+// ProjectionParameters returns the Athena table parameters projecting the partitions. With service
+// partitions, the configured service names and OtherServicePartition are enumerated. An injected
+// projection would make Athena reject all queries not filtering on a single service partition,
+// like trace lookups.
+func (s PartitionScheme) ProjectionParameters() map[string]string {
+	layout := s.layout()
+
+	parameters := map[string]string{
+		"projection.datehour.type":          "date",
+		"projection.datehour.format":        layout.projectionFormat,
+		"projection.datehour.range":         layout.projectionRangeStart + ",NOW",
+		"projection.datehour.interval":      layout.projectionInterval,
+		"projection.datehour.interval.unit": layout.projectionIntervalUnit,
+	}
+
+	if !s.serviceName {
+		return parameters
+	}
+
+	values := make([]string, 0, len(s.serviceKeys)+1)
+	for key := range s.serviceKeys {
+		values = append(values, key)
+	}
+	sort.Strings(values)
+	if !s.serviceKeys[OtherServicePartition] {
+		values = append(values, OtherServicePartition)
+	}
+
+	parameters["projection.service_partition.type"] = "enum"
+	parameters["projection.service_partition.values"] = strings.Join(values, ",")
+
+	return parameters
+}
@@ -0,0 +1,92 @@
+package s3spanstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionScheme(t *testing.T) {
+	testTime := time.Date(2021, 1, 30, 6, 34, 58, 123, time.UTC)
+
+	tests := []struct {
+		granularity      string
+		key              string
+		projectionFormat string
+		projectionUnit   string
+	}{
+		{granularity: "", key: "2021/01/30/06", projectionFormat: "yyyy/MM/dd/HH", projectionUnit: "HOURS"},
+		{granularity: "hour", key: "2021/01/30/06", projectionFormat: "yyyy/MM/dd/HH", projectionUnit: "HOURS"},
+		{granularity: "day", key: "2021/01/30", projectionFormat: "yyyy/MM/dd", projectionUnit: "DAYS"},
+		{granularity: "15m", key: "2021/01/30/06/30", projectionFormat: "yyyy/MM/dd/HH/mm", projectionUnit: "MINUTES"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.granularity, func(t *testing.T) {
+			assert := assert.New(t)
+
+			partitions, err := NewPartitionScheme(config.Partitioning{Granularity: tt.granularity})
+			assert.NoError(err)
+
+			assert.Equal(tt.key, partitions.Key(testTime))
+			assert.Equal("datehour BETWEEN '"+tt.key+"' AND '"+tt.key+"'", partitions.Condition(testTime, testTime))
+
+			parameters := partitions.ProjectionParameters()
+			assert.Equal(tt.projectionFormat, parameters["projection.datehour.format"])
+			assert.Equal(tt.projectionUnit, parameters["projection.datehour.interval.unit"])
+		})
+	}
+}
+
+func TestPartitionSchemeZeroValue(t *testing.T) {
+	assert := assert.New(t)
+
+	testTime := time.Date(2021, 1, 30, 6, 34, 58, 123, time.UTC)
+
+	assert.Equal(PartitionGranularityHour, PartitionScheme{}.Granularity())
+	assert.Equal("2021/01/30/06", PartitionScheme{}.Key(testTime))
+}
+
+func TestPartitionSchemeUnknownGranularity(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewPartitionScheme(config.Partitioning{Granularity: "week"})
+	assert.Error(err)
+}
+
+func TestPartitionSchemeServiceName(t *testing.T) {
+	assert := assert.New(t)
+
+	testTime := time.Date(2021, 1, 30, 6, 34, 58, 123, time.UTC)
+
+	_, err := NewPartitionScheme(config.Partitioning{ServiceName: true})
+	assert.Error(err)
+
+	partitions, err := NewPartitionScheme(config.Partitioning{
+		ServiceName:  true,
+		ServiceNames: []string{"frontend", "my service/v1", "my/service/v1"},
+	})
+	assert.NoError(err)
+
+	assert.Equal("2021/01/30/06/frontend", partitions.Path(testTime, &SpanRecord{ServiceName: "frontend"}))
+	assert.Equal("2021/01/30/06/my_service_v1", partitions.Path(testTime, &OperationRecord{ServiceName: "my service/v1"}))
+	assert.Equal("2021/01/30/06/_other", partitions.Path(testTime, &SpanRecord{ServiceName: "backend"}))
+	assert.Equal("2021/01/30/06/_other", partitions.Path(testTime, &SpanRecord{}))
+	assert.True(partitions.ServiceListed("my/service/v1"))
+	assert.False(partitions.ServiceListed("backend"))
+	assert.Equal("service_partition IN ('my_service_v1', '_other')", partitions.ServiceCondition("my service/v1"))
+	assert.Equal("service_partition = '_other'", partitions.ServiceCondition("backend"))
+	assert.Equal([]string{"datehour", "service_partition"}, partitions.PartitionColumns())
+	assert.Equal("s3://bucket/spans/${datehour}/${service_partition}/", partitions.LocationTemplate("s3://bucket/spans/"))
+
+	parameters := partitions.ProjectionParameters()
+	assert.Equal("enum", parameters["projection.service_partition.type"])
+	assert.Equal("frontend,my_service_v1,_other", parameters["projection.service_partition.values"])
+
+	withoutServiceName := partitions.WithoutServiceName()
+	assert.Equal("2021/01/30/06", withoutServiceName.Path(testTime, &SpanRecord{ServiceName: "frontend"}))
+	assert.Empty(withoutServiceName.ServiceCondition("frontend"))
+	assert.NotContains(withoutServiceName.ProjectionParameters(), "projection.service_partition.type")
+}
@@ -0,0 +1,181 @@
+package s3spanstore
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/layout"
+	"github.com/xitongsys/parquet-go/marshal"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/schema"
+)
+
+// PromotedTagColumn returns the column of a promoted tag key, e.g. tag_http_status_code for http.status_code
+func PromotedTagColumn(key string) string {
+	var column strings.Builder
+	column.WriteString("tag_")
+	for _, c := range strings.ToLower(key) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			column.WriteRune(c)
+		} else {
+			column.WriteRune('_')
+		}
+	}
+
+	return column.String()
+}
+
+// PromotedTagColumns returns the columns of the promoted tag keys in the given order
+func PromotedTagColumns(keys []string) ([]string, error) {
+	columns, err := newPromotedTagColumns(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(columns))
+	for _, column := range columns {
+		names = append(names, column.name)
+	}
+
+	return names, nil
+}
+
+type promotedTagColumn struct {
+	key  string
+	name string
+}
+
+// newPromotedTagColumns returns the columns of the promoted tag keys. Keys mapping to the same column are rejected.
+func newPromotedTagColumns(keys []string) ([]promotedTagColumn, error) {
+	columns := make([]promotedTagColumn, 0, len(keys))
+	keysByColumn := make(map[string]string, len(keys))
+
+	for _, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("promoted tag key can't be empty")
+		}
+
+		name := PromotedTagColumn(key)
+		if other, ok := keysByColumn[name]; ok {
+			if other == key {
+				continue
+			}
+			return nil, fmt.Errorf("promoted tags %q and %q are both written into the column %s", other, key, name)
+		}
+		keysByColumn[name] = key
+
+		columns = append(columns, promotedTagColumn{key: key, name: name})
+	}
+
+	return columns, nil
+}
+
+// promotedTag returns the searchable value of a tag key. Span tags take precedence over process tags
+// and process tags over log fields, of which the first one is used.
+func (r *SpanRecord) promotedTag(key string) (string, bool) {
+	if value, ok := r.SpanTags[key]; ok {
+		return value, true
+	}
+
+	if value, ok := r.ProcessTags[key]; ok {
+		return value, true
+	}
+
+	for _, log := range r.Logs {
+		if value, ok := log.Fields[key]; ok {
+			return value, true
+		}
+	}
+
+	return "", false
+}
+
+// spanRecordSchema writes span records with an additional dictionary encoded column per promoted tag.
+// Spans without the tag contain null.
+type spanRecordSchema struct {
+	columns []promotedTagColumn
+}
+
+func newSpanRecordSchema(promotedTags []string) (*spanRecordSchema, error) {
+	columns, err := newPromotedTagColumns(promotedTags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse promoted tags: %w", err)
+	}
+
+	return &spanRecordSchema{columns: columns}, nil
+}
+
+// SchemaHandler returns the SpanRecord schema followed by the promoted tag columns. The parquet writer
+// renames the schema elements when being stopped, so every file needs its own schema handler.
+func (s *spanRecordSchema) SchemaHandler() (*schema.SchemaHandler, error) {
+	spanRecordSchemaHandler, err := schema.NewSchemaHandlerFromStruct(new(SpanRecord))
+	if err != nil {
+		return nil, err
+	}
+
+	elements := append([]*parquet.SchemaElement{}, spanRecordSchemaHandler.SchemaElements...)
+	infos := append([]*common.Tag{}, spanRecordSchemaHandler.Infos...)
+
+	for _, column := range s.columns {
+		info, err := common.StringToTag(fmt.Sprintf("name=%s, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY, repetitiontype=OPTIONAL", column.name))
+		if err != nil {
+			return nil, err
+		}
+
+		element, err := common.NewSchemaElementFromTagMap(info)
+		if err != nil {
+			return nil, err
+		}
+
+		elements = append(elements, element)
+		infos = append(infos, info)
+	}
+
+	root := *elements[0]
+	numChildren := root.GetNumChildren() + int32(len(s.columns))
+	root.NumChildren = &numChildren
+	elements[0] = &root
+
+	schemaHandler := schema.NewSchemaHandlerFromSchemaList(elements)
+	schemaHandler.Infos = infos
+	schemaHandler.CreateInExMap()
+
+	return schemaHandler, nil
+}
+
+// Marshal marshals the SpanRecord fields and adds the promoted tag values
+func (s *spanRecordSchema) Marshal(rows []interface{}, schemaHandler *schema.SchemaHandler) (*map[string]*layout.Table, error) {
+	tables, err := marshal.Marshal(rows, schemaHandler)
+	if err != nil {
+		return nil, err
+	}
+
+	rootInName := schemaHandler.GetRootInName()
+	for _, column := range s.columns {
+		table := (*tables)[common.PathToStr([]string{rootInName, common.StringToVariableName(column.name)})]
+
+		for _, row := range rows {
+			var spanRecord *SpanRecord
+			switch row := row.(type) {
+			case *SpanRecord:
+				spanRecord = row
+			case SpanRecord:
+				spanRecord = &row
+			default:
+				return nil, fmt.Errorf("unexpected row type %T", row)
+			}
+
+			if value, ok := spanRecord.promotedTag(column.key); ok {
+				table.Values = append(table.Values, value)
+				table.DefinitionLevels = append(table.DefinitionLevels, 1)
+			} else {
+				table.Values = append(table.Values, nil)
+				table.DefinitionLevels = append(table.DefinitionLevels, 0)
+			}
+			table.RepetitionLevels = append(table.RepetitionLevels, 0)
+		}
+	}
+
+	return tables, nil
+}
@@ -0,0 +1,21 @@
+package s3spanstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPromotedTagColumns(t *testing.T) {
+	assert := assert.New(t)
+
+	columns, err := PromotedTagColumns([]string{"http.status_code", "k8s.namespace", "Error", "http.status_code"})
+	assert.NoError(err)
+	assert.Equal([]string{"tag_http_status_code", "tag_k8s_namespace", "tag_error"}, columns)
+
+	_, err = PromotedTagColumns([]string{""})
+	assert.ErrorContains(err, "promoted tag key can't be empty")
+
+	_, err = PromotedTagColumns([]string{"error", "Error"})
+	assert.ErrorContains(err, `promoted tags "error" and "Error" are both written into the column tag_error`)
+}
@@ -0,0 +1,38 @@
+package s3spanstore
+
+import (
+	"context"
+	"time"
+)
+
+// QueryRow contains the values of a single result row in their string representation.
+// NULL values are represented as empty strings.
+type QueryRow []string
+
+// QueryKind identifies the Reader operation a query is executed for, used for accounting.
+type QueryKind string
+
+const (
+	QueryKindGetTrace        QueryKind = "GetTrace"
+	QueryKindFindTraces      QueryKind = "FindTraces"
+	QueryKindGetServices     QueryKind = "GetServices"
+	QueryKindGetOperations   QueryKind = "GetOperations"
+	QueryKindGetDependencies QueryKind = "GetDependencies"
+)
+
+// QueryEngine executes the SQL queries of the Reader against the spans and operations tables.
+type QueryEngine interface {
+	// Query executes the query and returns the result rows without the header.
+	Query(ctx context.Context, kind QueryKind, query string) ([]QueryRow, error)
+	// QueryCached returns the result of a recent query containing lookup, if the engine
+	// supports caching and such a query has been executed within ttl, otherwise it executes query.
+	QueryCached(ctx context.Context, kind QueryKind, query string, lookup string, ttl time.Duration) ([]QueryRow, error)
+	// MapElement returns an expression accessing key within the map column.
+	MapElement(column string, key string) string
+	// AnyElement returns an expression, which is true when condition is true for any element of the
+	// array column. Within condition the element is accessible as variable.
+	AnyElement(column string, variable string, condition string) string
+	// DecodeBinary decodes the representation of a varbinary value within a QueryRow.
+	DecodeBinary(value string) ([]byte, error)
+	Close() error
+}
@@ -3,37 +3,32 @@ package s3spanstore
 import (
 	"context"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/athena"
-	"github.com/aws/aws-sdk-go-v2/service/athena/types"
 	"github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/model"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
 	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
 	"github.com/opentracing/opentracing-go"
+	"github.com/uber/jaeger-lib/metrics"
 )
 
-// mockgen -destination=./plugin/s3spanstore/mocks/mock_athena.go -package=mocks github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore AthenaAPI
-
-type AthenaAPI interface {
-	BatchGetQueryExecution(ctx context.Context, params *athena.BatchGetQueryExecutionInput, optFns ...func(*athena.Options)) (*athena.BatchGetQueryExecutionOutput, error)
-	GetQueryExecution(ctx context.Context, params *athena.GetQueryExecutionInput, optFns ...func(*athena.Options)) (*athena.GetQueryExecutionOutput, error)
-	GetQueryResults(ctx context.Context, params *athena.GetQueryResultsInput, optFns ...func(*athena.Options)) (*athena.GetQueryResultsOutput, error)
-	ListQueryExecutions(ctx context.Context, params *athena.ListQueryExecutionsInput, optFns ...func(*athena.Options)) (*athena.ListQueryExecutionsOutput, error)
-	StartQueryExecution(ctx context.Context, params *athena.StartQueryExecutionInput, optFns ...func(*athena.Options)) (*athena.StartQueryExecutionOutput, error)
-	StopQueryExecution(ctx context.Context, params *athena.StopQueryExecutionInput, optFns ...func(*athena.Options)) (*athena.StopQueryExecutionOutput, error)
-}
-
 var (
 	defaultMaxTraceDuration     = time.Hour * 24
 	defaultDependenciesQueryTTL = time.Hour * 24
 	defaultServicesQueryTtl     = time.Second * 60
 )
 
-func NewReader(ctx context.Context, logger hclog.Logger, svc AthenaAPI, cfg config.Athena) (*Reader, error) {
+func NewReader(ctx context.Context, logger hclog.Logger, metricsFactory metrics.Factory, svc AthenaAPI, cfg config.Athena, partitions PartitionScheme, promotedTags []string) (*Reader, error) {
+	return NewReaderWithQueryEngine(ctx, logger, NewAthenaQueryEngine(logger, metricsFactory, svc, cfg), cfg, partitions, promotedTags)
+}
+
+// NewReaderWithQueryEngine creates a reader using the given query engine. The promoted tags are the
+// ones written by the writer (s3.promotedTags), so their columns need to exist in the spans table.
+func NewReaderWithQueryEngine(ctx context.Context, logger hclog.Logger, engine QueryEngine, cfg config.Athena, partitions PartitionScheme, promotedTags []string) (*Reader, error) {
 	maxSpanAge, err := time.ParseDuration(cfg.MaxSpanAge)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse max timeframe: %w", err)
@@ -54,14 +49,24 @@ func NewReader(ctx context.Context, logger hclog.Logger, svc AthenaAPI, cfg conf
 		return nil, fmt.Errorf("failed to parse max trace duration: %w", err)
 	}
 
+	promotedTagColumns, err := newPromotedTagColumns(promotedTags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse promoted tags: %w", err)
+	}
+	promotedTagColumnNames := make(map[string]string, len(promotedTagColumns))
+	for _, column := range promotedTagColumns {
+		promotedTagColumnNames[column.key] = column.name
+	}
+
 	reader := &Reader{
-		svc:                  svc,
+		engine:               engine,
 		cfg:                  cfg,
+		partitions:           partitions,
+		promotedTags:         promotedTagColumnNames,
 		logger:               logger,
 		maxSpanAge:           maxSpanAge,
 		dependenciesQueryTTL: dependenciesQueryTTL,
 		servicesQueryTTL:     servicesQueryTTL,
-		athenaQueryCache:     NewAthenaQueryCache(logger, svc, cfg.WorkGroup),
 		maxTraceDuration:     maxTraceDuration,
 	}
 
@@ -73,18 +78,23 @@ func NewReader(ctx context.Context, logger hclog.Logger, svc AthenaAPI, cfg conf
 
 type Reader struct {
 	logger               hclog.Logger
-	svc                  AthenaAPI
+	engine               QueryEngine
 	cfg                  config.Athena
+	partitions           PartitionScheme
+	promotedTags         map[string]string
 	maxSpanAge           time.Duration
 	dependenciesQueryTTL time.Duration
 	servicesQueryTTL     time.Duration
-	athenaQueryCache     *AthenaQueryCache
 	dependenciesPrefetch *DependenciesPrefetch
 	maxTraceDuration     time.Duration
 }
 
 const (
 	ATHENA_TIMEFORMAT = "2006-01-02 15:04:05.999"
+
+	// ROOT_SPAN_SEARCH_KEY restricts searches to root spans (jaeger-s3.root=true) or to spans having a parent
+	// (jaeger-s3.root=false). It is prefixed, so it doesn't collide with span tags, which stay searchable.
+	ROOT_SPAN_SEARCH_KEY = "jaeger-s3.root"
 )
 
 func (r *Reader) DefaultMaxTime() time.Time {
@@ -101,13 +111,13 @@ func (s *Reader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Tr
 	defer otSpan.Finish()
 
 	conditions := []string{
-		fmt.Sprintf(`datehour BETWEEN '%s' AND '%s'`, s.DefaultMinTime().Format(PARTION_FORMAT), s.DefaultMaxTime().Format(PARTION_FORMAT)),
-		fmt.Sprintf(`trace_id = '%s'`, traceID),
+		s.partitions.Condition(s.DefaultMinTime(), s.DefaultMaxTime()),
+		fmt.Sprintf(`trace_id = %s`, sqlString(traceID.String())),
 	}
 
-	result, err := s.queryAthena(ctx, fmt.Sprintf(`SELECT DISTINCT span_payload FROM "%s" WHERE %s`, s.cfg.SpansTableName, strings.Join(conditions, " AND ")))
+	result, err := s.engine.Query(ctx, QueryKindGetTrace, fmt.Sprintf(`SELECT DISTINCT schema_version, span_payload FROM "%s" WHERE %s`, s.cfg.SpansTableName, strings.Join(conditions, " AND ")))
 	if err != nil {
-		return nil, fmt.Errorf("failed to query athena: %w", err)
+		return nil, fmt.Errorf("failed to query: %w", err)
 	}
 	if len(result) == 0 {
 		return nil, spanstore.ErrTraceNotFound
@@ -115,7 +125,7 @@ func (s *Reader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Tr
 
 	spans := make([]*model.Span, len(result))
 	for i, v := range result {
-		span, err := DecodeSpanPayload(*v.Data[0].VarCharValue)
+		span, err := s.decodeSpanPayload(v[0], v[1])
 		if err != nil {
 			return nil, fmt.Errorf("failed to unmarshal span: %w", err)
 		}
@@ -127,27 +137,38 @@ func (s *Reader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Tr
 	}, nil
 }
 
+// decodeSpanPayload decodes the span payload in the binary representation of the query engine
+func (r *Reader) decodeSpanPayload(schemaVersion string, payload string) (*model.Span, error) {
+	payloadBytes, err := r.engine.DecodeBinary(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode binary: %w", err)
+	}
+
+	return DecodeSpanPayloadWithSchemaVersion(schemaVersion, payloadBytes)
+}
+
 func (s *Reader) GetServices(ctx context.Context) ([]string, error) {
 	s.logger.Trace("GetServices")
 	otSpan, _ := opentracing.StartSpanFromContext(ctx, "GetServices")
 	defer otSpan.Finish()
 
 	conditions := []string{
-		fmt.Sprintf(`datehour BETWEEN '%s' AND '%s'`, s.DefaultMinTime().Format(PARTION_FORMAT), s.DefaultMaxTime().Format(PARTION_FORMAT)),
+		s.partitions.Condition(s.DefaultMinTime(), s.DefaultMaxTime()),
 	}
 
-	result, err := s.queryAthenaCached(
+	result, err := s.engine.QueryCached(
 		ctx,
+		QueryKindGetServices,
 		fmt.Sprintf(`SELECT distinct service_name FROM "%s" WHERE %s`, s.cfg.OperationsTableName, strings.Join(conditions, " AND ")),
         "SELECT distinct service_name",
 		s.servicesQueryTTL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query athena: %w", err)
+		return nil, fmt.Errorf("failed to query: %w", err)
 	}
 
 	serviceNames := make([]string, len(result))
 	for i, v := range result {
-		serviceName := *v.Data[0].VarCharValue
+		serviceName := v[0]
 		serviceNames[i] = serviceName
 	}
 
@@ -160,15 +181,19 @@ func (s *Reader) GetOperations(ctx context.Context, query spanstore.OperationQue
 	defer span.Finish()
 
 	conditions := []string{
-		fmt.Sprintf(`service_name = '%s'`, query.ServiceName),
-		fmt.Sprintf(`datehour BETWEEN '%s' AND '%s'`, s.DefaultMinTime().Format(PARTION_FORMAT), s.DefaultMaxTime().Format(PARTION_FORMAT)),
+		fmt.Sprintf(`service_name = %s`, sqlString(query.ServiceName)),
+		s.partitions.Condition(s.DefaultMinTime(), s.DefaultMaxTime()),
+	}
+	if condition := s.partitions.ServiceCondition(query.ServiceName); condition != "" {
+		conditions = append(conditions, condition)
 	}
 	if query.SpanKind != "" {
-		conditions = append(conditions, fmt.Sprintf(`span_kind = '%s'`, query.SpanKind))
+		conditions = append(conditions, fmt.Sprintf(`span_kind = %s`, sqlString(query.SpanKind)))
 	}
 
-	result, err := s.queryAthenaCached(
+	result, err := s.engine.QueryCached(
 		ctx,
+		QueryKindGetOperations,
 		fmt.Sprintf(`
 SELECT distinct operation_name, span_kind
 FROM "%s"
@@ -178,14 +203,14 @@ WHERE %s`,
         "SELECT distinct operation_name",
 		s.servicesQueryTTL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query athena: %w", err)
+		return nil, fmt.Errorf("failed to query: %w", err)
 	}
 
 	operations := make([]spanstore.Operation, len(result))
 	for i, v := range result {
 		operations[i] = spanstore.Operation{
-			Name:     *v.Data[0].VarCharValue,
-			SpanKind: *v.Data[1].VarCharValue,
+			Name:     v[0],
+			SpanKind: v[1],
 		}
 	}
 
@@ -218,19 +243,19 @@ func (r *Reader) FindTraces(ctx context.Context, query *spanstore.TraceQueryPara
 
 	// Fetch span details, but only look into partitions +/- maxTraceDurations
 	spanConditions := []string{
-		fmt.Sprintf(`datehour BETWEEN '%s' AND '%s'`, query.StartTimeMin.Add(-r.maxTraceDuration).Format(PARTION_FORMAT), query.StartTimeMax.Add(r.maxTraceDuration).Format(PARTION_FORMAT)),
-		fmt.Sprintf(`trace_id IN ('%s')`, strings.Join(traceIDs, `', '`)),
+		r.partitions.Condition(query.StartTimeMin.Add(-r.maxTraceDuration), query.StartTimeMax.Add(r.maxTraceDuration)),
+		fmt.Sprintf(`trace_id IN (%s)`, sqlStringList(traceIDs)),
 	}
 
-	spanResult, err := r.queryAthena(ctx, fmt.Sprintf(`SELECT DISTINCT trace_id, span_payload FROM "%s" WHERE %s`, r.cfg.SpansTableName, strings.Join(spanConditions, " AND ")))
+	spanResult, err := r.engine.Query(ctx, QueryKindFindTraces, fmt.Sprintf(`SELECT DISTINCT trace_id, schema_version, span_payload FROM "%s" WHERE %s`, r.cfg.SpansTableName, strings.Join(spanConditions, " AND ")))
 	if err != nil {
-		return nil, fmt.Errorf("failed to query athena: %w", err)
+		return nil, fmt.Errorf("failed to query: %w", err)
 	}
 
 	traceIdSpans := map[string][]*model.Span{}
 	for _, v := range spanResult {
-		traceId := *v.Data[0].VarCharValue
-		span, err := DecodeSpanPayload(*v.Data[1].VarCharValue)
+		traceId := v[0]
+		span, err := r.decodeSpanPayload(v[1], v[2])
 		if err != nil {
 			return nil, fmt.Errorf("failed to unmarshal span: %w", err)
 		}
@@ -285,15 +310,27 @@ func (r *Reader) findTraceIDs(ctx context.Context, query *spanstore.TraceQueryPa
 	span, _ := opentracing.StartSpanFromContext(ctx, "findTraceIDs")
 	defer span.Finish()
 
-	// TODO Prevent SQL injections
-	conditions := []string{fmt.Sprintf(`service_name = '%s'`, query.ServiceName)}
+	// All user supplied values are passed as escaped string literals to prevent SQL injections
+	conditions := []string{fmt.Sprintf(`service_name = %s`, sqlString(query.ServiceName))}
+	if condition := r.partitions.ServiceCondition(query.ServiceName); condition != "" {
+		conditions = append(conditions, condition)
+	}
 
 	if query.OperationName != "" {
-		conditions = append(conditions, fmt.Sprintf(`operation_name = '%s'`, query.OperationName))
+		conditions = append(conditions, fmt.Sprintf(`operation_name = %s`, sqlString(query.OperationName)))
 	}
 
 	for key, value := range query.Tags {
-		conditions = append(conditions, fmt.Sprintf(`tags['%s'] = '%s'`, key, value))
+		if key == ROOT_SPAN_SEARCH_KEY {
+			if value != "true" && value != "false" {
+				return nil, fmt.Errorf("invalid value %q of %s, expected true or false", value, ROOT_SPAN_SEARCH_KEY)
+			}
+
+			conditions = append(conditions, r.rootSpanCondition(value == "true"))
+			continue
+		}
+
+		conditions = append(conditions, r.tagCondition(key, value))
 	}
 
 	if query.StartTimeMin.IsZero() {
@@ -304,7 +341,7 @@ func (r *Reader) findTraceIDs(ctx context.Context, query *spanstore.TraceQueryPa
 		query.StartTimeMax = r.DefaultMaxTime()
 	}
 
-	conditions = append(conditions, fmt.Sprintf(`datehour BETWEEN '%s' AND '%s'`, query.StartTimeMin.Format(PARTION_FORMAT), query.StartTimeMax.Format(PARTION_FORMAT)))
+	conditions = append(conditions, r.partitions.Condition(query.StartTimeMin, query.StartTimeMax))
 	conditions = append(conditions, fmt.Sprintf(`start_time BETWEEN timestamp '%s' AND timestamp '%s'`, query.StartTimeMin.Format(ATHENA_TIMEFORMAT), query.StartTimeMax.Format(ATHENA_TIMEFORMAT)))
 
 	if query.DurationMin.String() != "0s" && query.DurationMax.String() != "0s" {
@@ -316,9 +353,9 @@ func (r *Reader) findTraceIDs(ctx context.Context, query *spanstore.TraceQueryPa
 	}
 
 	// Fetch trace ids
-	result, err := r.queryAthena(ctx, fmt.Sprintf(`SELECT trace_id FROM "%s" WHERE %s GROUP BY 1 LIMIT %d`, r.cfg.SpansTableName, strings.Join(conditions, " AND "), query.NumTraces))
+	result, err := r.engine.Query(ctx, QueryKindFindTraces, fmt.Sprintf(`SELECT trace_id FROM "%s" WHERE %s GROUP BY 1 LIMIT %d`, r.cfg.SpansTableName, strings.Join(conditions, " AND "), query.NumTraces))
 	if err != nil {
-		return nil, fmt.Errorf("failed to query athena: %w", err)
+		return nil, fmt.Errorf("failed to query: %w", err)
 	}
 	if len(result) == 0 {
 		return nil, nil
@@ -326,7 +363,7 @@ func (r *Reader) findTraceIDs(ctx context.Context, query *spanstore.TraceQueryPa
 
 	traceIds := make([]string, len(result))
 	for i, v := range result {
-		traceIds[i] = *v.Data[0].VarCharValue
+		traceIds[i] = v[0]
 	}
 
 	return traceIds, nil
@@ -340,41 +377,51 @@ func (r *Reader) GetDependencies(ctx context.Context, endTs time.Time, lookback
 	startTs := endTs.Add(-lookback)
 
 	conditions := []string{
-		fmt.Sprintf(`datehour BETWEEN '%s' AND '%s'`, startTs.Format(PARTION_FORMAT), endTs.Format(PARTION_FORMAT)),
+		r.partitions.Condition(startTs, endTs),
 	}
 
-	result, err := r.queryAthenaCached(ctx, fmt.Sprintf(`
-		WITH spans_with_references AS (
-			SELECT
-				base.service_name,
-				base.trace_id,
-				base.span_id,
-				unnested_references.reference.trace_id as ref_trace_id,
-				unnested_references.reference.span_id as ref_span_id
+	// Spans only referencing their parent are joined using the parent span id. All references of other spans
+	// and of files written before the parent span id was stored are unnested.
+	result, err := r.engine.QueryCached(ctx, QueryKindGetDependencies, fmt.Sprintf(`
+		WITH spans AS (
+			SELECT service_name, trace_id, span_id, parent_span_id, has_other_references, schema_version, base.references
 			FROM %s as base
-			CROSS JOIN UNNEST(base.references) AS unnested_references (reference)
+			WHERE %s
+		),
+
+		spans_with_references AS (
+			SELECT service_name, trace_id as ref_trace_id, parent_span_id as ref_span_id
+			FROM spans
+			WHERE schema_version >= %d AND parent_span_id <> '' AND NOT has_other_references
+
+			UNION ALL
+
+			SELECT spans.service_name, unnested_references.reference.trace_id as ref_trace_id, unnested_references.reference.span_id as ref_span_id
+			FROM spans
+			CROSS JOIN UNNEST(spans.references) AS unnested_references (reference)
+			WHERE COALESCE(schema_version, %d) < %d OR has_other_references
 		)
 
-		SELECT jaeger.service_name as parent, spans_with_references.service_name as child, COUNT(*) as callcount
+		SELECT parent.service_name as parent, spans_with_references.service_name as child, COUNT(*) as callcount
 			FROM spans_with_references
-			JOIN %s as jaeger ON spans_with_references.ref_trace_id = jaeger.trace_id AND spans_with_references.ref_span_id = jaeger.span_id
-			WHERE %s
+			JOIN spans as parent ON spans_with_references.ref_trace_id = parent.trace_id AND spans_with_references.ref_span_id = parent.span_id
 			GROUP BY 1, 2
-	`, r.cfg.SpansTableName, r.cfg.SpansTableName, strings.Join(conditions, " AND ")), "WITH spans_with_reference", r.dependenciesQueryTTL)
+	`, r.cfg.SpansTableName, strings.Join(conditions, " AND "),
+		SCHEMA_VERSION_PARENT_SPAN_ID, SCHEMA_VERSION_BASE64_PAYLOAD, SCHEMA_VERSION_PARENT_SPAN_ID), "WITH spans AS", r.dependenciesQueryTTL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query athena: %w", err)
+		return nil, fmt.Errorf("failed to query: %w", err)
 	}
 
 	dependencyLinks := make([]model.DependencyLink, len(result))
 	for i, v := range result {
-		callCount, err := strconv.ParseUint(*v.Data[2].VarCharValue, 10, 64)
+		callCount, err := strconv.ParseUint(v[2], 10, 64)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse call count: %w", err)
 		}
 
 		dependencyLinks[i] = model.DependencyLink{
-			Parent:    *v.Data[0].VarCharValue,
-			Child:     *v.Data[1].VarCharValue,
+			Parent:    v[0],
+			Child:     v[1],
 			CallCount: callCount,
 		}
 	}
@@ -382,103 +429,85 @@ func (r *Reader) GetDependencies(ctx context.Context, endTs time.Time, lookback
 	return dependencyLinks, nil
 }
 
-func (r *Reader) queryAthenaCached(ctx context.Context, queryString string, lookupString string, ttl time.Duration) ([]types.Row, error) {
-	otSpan, _ := opentracing.StartSpanFromContext(ctx, "queryAthenaCached")
-	defer otSpan.Finish()
-
-	queryExecution, err := r.athenaQueryCache.Lookup(ctx, lookupString, ttl)
-	if err != nil {
-		return nil, fmt.Errorf("failed to lookup cached athena query: %w", err)
-	}
+func (r *Reader) Close() error {
+	r.dependenciesPrefetch.Stop()
+	return nil
+}
 
-	if queryExecution != nil {
-		return r.waitAndFetchQueryResult(ctx, queryExecution)
+// rootSpanCondition matches root spans or spans having a parent. Files written before the root flag was stored
+// are matched using their references.
+func (r *Reader) rootSpanCondition(root bool) string {
+	condition := fmt.Sprintf(`CASE WHEN COALESCE(schema_version, %d) >= %d THEN is_root ELSE NOT %s END`,
+		SCHEMA_VERSION_BASE64_PAYLOAD, SCHEMA_VERSION_PARENT_SPAN_ID,
+		r.engine.AnyElement(`"references"`, "reference", fmt.Sprintf(`reference.ref_type = %d AND reference.trace_id = trace_id`, model.ChildOf)))
+	if !root {
+		return fmt.Sprintf(`NOT (%s)`, condition)
 	}
 
-	return r.queryAthena(ctx, queryString)
+	return fmt.Sprintf(`(%s)`, condition)
 }
 
-func (r *Reader) queryAthena(ctx context.Context, queryString string) ([]types.Row, error) {
-	otSpan, _ := opentracing.StartSpanFromContext(ctx, "queryAthena")
-	defer otSpan.Finish()
-
-	output, err := r.svc.StartQueryExecution(ctx, &athena.StartQueryExecutionInput{
-		QueryString: &queryString,
-		QueryExecutionContext: &types.QueryExecutionContext{
-			Database: &r.cfg.DatabaseName,
-		},
-		ResultConfiguration: &types.ResultConfiguration{
-			OutputLocation: &r.cfg.OutputLocation,
-		},
-		WorkGroup: &r.cfg.WorkGroup,
-	})
+// tagComparisonOperators are the operators, which can prefix numeric tag values, e.g. >=500
+var tagComparisonOperators = []string{">=", "<=", ">", "<"}
+
+// tagCondition matches a tag value. Numeric values prefixed by a comparison operator are compared to the
+// int and float tags. Numeric and boolean values additionally match the typed tags, which doesn't depend
+// on the formatting of the value. Promoted tags additionally match their column, which finds the same
+// spans as the tag maps, as the column only contains a value of the tag maps, see SpanRecord.promotedTag.
+func (r *Reader) tagCondition(key string, value string) string {
+	for _, operator := range tagComparisonOperators {
+		if !strings.HasPrefix(value, operator) {
+			continue
+		}
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to start athena query: %w", err)
+		if number, ok := parseTagNumber(strings.TrimSpace(strings.TrimPrefix(value, operator))); ok {
+			return fmt.Sprintf(`(%s %s %s OR %s %s %s)`,
+				r.engine.MapElement("int_tags", key), operator, number,
+				r.engine.MapElement("float_tags", key), operator, number)
+		}
+		break
 	}
 
-	status, err := r.svc.GetQueryExecution(ctx, &athena.GetQueryExecutionInput{
-		QueryExecutionId: output.QueryExecutionId,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to get athena query execution: %w", err)
+	condition := r.stringTagCondition(key, value)
+	if column, ok := r.promotedTags[key]; ok {
+		condition = fmt.Sprintf(`(%s = %s OR %s)`, column, sqlString(value), condition)
 	}
 
-	return r.waitAndFetchQueryResult(ctx, status.QueryExecution)
-}
-
-func (r *Reader) waitAndFetchQueryResult(ctx context.Context, queryExecution *types.QueryExecution) ([]types.Row, error) {
-	otSpan, _ := opentracing.StartSpanFromContext(ctx, "waitAndFetchQueryResult")
-	defer otSpan.Finish()
-
-	// Poll until the query completed
-	for {
-		if queryExecution.Status.CompletionDateTime != nil {
-			break
-		}
-
-		time.Sleep(100 * time.Millisecond)
+	if integer, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return fmt.Sprintf(`(%s OR %s = %d)`, condition, r.engine.MapElement("int_tags", key), integer)
+	}
 
-		status, err := r.svc.GetQueryExecution(ctx, &athena.GetQueryExecutionInput{
-			QueryExecutionId: queryExecution.QueryExecutionId,
-		})
-		if err != nil {
-			return nil, fmt.Errorf("failed to get athena query execution: %w", err)
-		}
+	if number, ok := parseTagNumber(value); ok {
+		return fmt.Sprintf(`(%s OR %s = %s)`, condition, r.engine.MapElement("float_tags", key), number)
+	}
 
-		queryExecution = status.QueryExecution
+	if value == "true" || value == "false" {
+		return fmt.Sprintf(`(%s OR %s = %s)`, condition, r.engine.MapElement("bool_tags", key), value)
 	}
 
-	return r.fetchQueryResult(ctx, queryExecution.QueryExecutionId)
+	return condition
 }
 
-func (r *Reader) fetchQueryResult(ctx context.Context, queryExecutionId *string) ([]types.Row, error) {
-	otSpan, _ := opentracing.StartSpanFromContext(ctx, "fetchQueryResult")
-	defer otSpan.Finish()
-
-	// Get query results
-	paginator := athena.NewGetQueryResultsPaginator(r.svc, &athena.GetQueryResultsInput{
-		QueryExecutionId: queryExecutionId,
-	})
-	rows := []types.Row{}
-	for paginator.HasMorePages() {
-		output, err := paginator.NextPage(ctx)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get athena query result: %w", err)
-		}
+// stringTagCondition matches span tags, process tags and log fields like Jaeger. The merged tags are
+// only written by previous versions.
+func (r *Reader) stringTagCondition(key string, value string) string {
+	return fmt.Sprintf(`(%s = %s OR %s = %s OR %s = %s OR %s)`,
+		r.engine.MapElement("span_tags", key), sqlString(value),
+		r.engine.MapElement("process_tags", key), sqlString(value),
+		r.engine.MapElement("tags", key), sqlString(value),
+		r.engine.AnyElement("logs", "log", fmt.Sprintf(`%s = %s`, r.engine.MapElement("log.fields", key), sqlString(value))))
+}
 
-		rows = append(rows, output.ResultSet.Rows...)
+// parseTagNumber parses a finite number and formats it as SQL literal, which is safe to be used in queries
+func parseTagNumber(value string) (string, bool) {
+	if integer, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return strconv.FormatInt(integer, 10), true
 	}
 
-	// Remove the table header
-	if len(rows) >= 1 {
-		rows = rows[1:]
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsInf(number, 0) || math.IsNaN(number) {
+		return "", false
 	}
 
-	return rows, nil
-}
-
-func (r *Reader) Close() error {
-	r.dependenciesPrefetch.Stop()
-	return nil
+	return strconv.FormatFloat(number, 'f', -1, 64), true
 }
@@ -2,7 +2,9 @@ package s3spanstore
 
 import (
 	"context"
+	"encoding/hex"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -14,6 +16,7 @@ import (
 	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
 	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore/mocks"
 	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-lib/metrics"
 )
 
 func NewTestReader(ctx context.Context, assert *assert.Assertions, mockSvc *mocks.MockAthenaAPI) *Reader {
@@ -30,7 +33,7 @@ func NewTestReader(ctx context.Context, assert *assert.Assertions, mockSvc *mock
 		JSONFormat: true,
 	})
 
-	reader, err := NewReader(ctx, logger, mockSvc, config.Athena{
+	reader, err := NewReader(ctx, logger, metrics.NullFactory, mockSvc, config.Athena{
 		DatabaseName:         "default",
 		SpansTableName:       "jaeger_spans",
 		OperationsTableName:  "jaeger_operations",
@@ -39,7 +42,7 @@ func NewTestReader(ctx context.Context, assert *assert.Assertions, mockSvc *mock
 		MaxSpanAge:           "336h",
 		DependenciesQueryTTL: "6h",
 		ServicesQueryTTL:     "10s",
-	})
+	}, PartitionScheme{}, nil)
 
 	assert.NoError(err)
 
@@ -64,6 +67,16 @@ func toAthenaResultSet(results [][]string) *types.ResultSet {
 	return &types.ResultSet{Rows: resultsRows}
 }
 
+// toAthenaVarbinary returns value in the representation of varbinary values in Athena query results
+func toAthenaVarbinary(value string) string {
+	encoded := make([]string, len(value))
+	for i := 0; i < len(value); i++ {
+		encoded[i] = hex.EncodeToString([]byte{value[i]})
+	}
+
+	return strings.Join(encoded, " ")
+}
+
 func mockQueryRunAndResult(mockSvc *mocks.MockAthenaAPI, result [][]string) {
 	queryID := "queryId"
 	now := time.Now()
@@ -149,3 +162,434 @@ func TestGetOperations(t *testing.T) {
 		},
 	}, operations)
 }
+
+func mockQueryRunAndCapture(mockSvc *mocks.MockAthenaAPI, result [][]string, queryString *string) {
+	queryID := "queryId"
+	now := time.Now()
+
+	mockSvc.EXPECT().StartQueryExecution(gomock.Any(), gomock.Any()).
+		DoAndReturn(func(_ context.Context, input *athena.StartQueryExecutionInput, _ ...func(*athena.Options)) (*athena.StartQueryExecutionOutput, error) {
+			*queryString = *input.QueryString
+
+			return &athena.StartQueryExecutionOutput{
+				QueryExecutionId: &queryID,
+			}, nil
+		})
+	mockSvc.EXPECT().GetQueryExecution(gomock.Any(), gomock.Any()).
+		Return(&athena.GetQueryExecutionOutput{
+			QueryExecution: &types.QueryExecution{
+				Status: &types.QueryExecutionStatus{
+					CompletionDateTime: &now,
+				},
+			},
+		}, nil)
+	mockSvc.EXPECT().GetQueryResults(gomock.Any(), gomock.Any()).
+		Return(&athena.GetQueryResultsOutput{
+			ResultSet: toAthenaResultSet(result),
+		}, nil)
+}
+
+// stripSQLStringLiterals replaces all string literals within query by `?`,
+// returning only the parts of the query that are interpreted as SQL.
+func stripSQLStringLiterals(assert *assert.Assertions, query string) string {
+	var b strings.Builder
+	inLiteral := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		if c != '\'' {
+			if !inLiteral {
+				b.WriteByte(c)
+			}
+			continue
+		}
+
+		if inLiteral && i+1 < len(query) && query[i+1] == '\'' {
+			i++
+			continue
+		}
+
+		if !inLiteral {
+			b.WriteByte('?')
+		}
+		inLiteral = !inLiteral
+	}
+
+	assert.False(inLiteral, "unterminated string literal in %s", query)
+
+	return b.String()
+}
+
+var hostileInputs = []string{
+	`' OR '1'='1`,
+	`'; DROP TABLE jaeger_spans; --`,
+	`test' --`,
+	`test\' OR 1=1 --`,
+	`''''`,
+	`' UNION SELECT trace_id FROM jaeger_spans WHERE ''='`,
+	"test'\n OR 1=1",
+}
+
+func TestFindTraceIDsEscapesHostileInput(t *testing.T) {
+	for _, input := range hostileInputs {
+		input := input
+
+		t.Run(input, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			assert := assert.New(t)
+			ctx := context.TODO()
+
+			mockSvc := mocks.NewMockAthenaAPI(ctrl)
+
+			var queryString string
+			mockQueryRunAndCapture(mockSvc, [][]string{}, &queryString)
+
+			reader := NewTestReader(ctx, assert, mockSvc)
+
+			traceIDs, err := reader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+				ServiceName:   input,
+				OperationName: input,
+				Tags:          map[string]string{input: input},
+				NumTraces:     20,
+			})
+
+			assert.NoError(err)
+			assert.Nil(traceIDs)
+
+			escapedInput := strings.ReplaceAll(input, "'", "''")
+			assert.Contains(queryString, `service_name = '`+escapedInput+`'`)
+			assert.Contains(queryString, `operation_name = '`+escapedInput+`'`)
+			assert.Contains(queryString, `element_at(span_tags, '`+escapedInput+`') = '`+escapedInput+`'`)
+
+			sqlOnly := stripSQLStringLiterals(assert, queryString)
+			assert.NotContains(sqlOnly, "--")
+			assert.NotContains(sqlOnly, ";")
+			assert.NotContains(sqlOnly, "1=1")
+			assert.NotContains(sqlOnly, "UNION")
+			assert.NotContains(sqlOnly, "DROP")
+		})
+	}
+}
+
+func TestGetOperationsEscapesHostileInput(t *testing.T) {
+	for _, input := range hostileInputs {
+		input := input
+
+		t.Run(input, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			assert := assert.New(t)
+			ctx := context.TODO()
+
+			mockSvc := mocks.NewMockAthenaAPI(ctrl)
+			mockSvc.EXPECT().ListQueryExecutions(gomock.Any(), gomock.Any()).
+				Return(&athena.ListQueryExecutionsOutput{}, nil)
+
+			var queryString string
+			mockQueryRunAndCapture(mockSvc, [][]string{}, &queryString)
+
+			reader := NewTestReader(ctx, assert, mockSvc)
+
+			_, err := reader.GetOperations(ctx, spanstore.OperationQueryParameters{ServiceName: input, SpanKind: input})
+			assert.NoError(err)
+
+			escapedInput := strings.ReplaceAll(input, "'", "''")
+			assert.Contains(queryString, `service_name = '`+escapedInput+`'`)
+			assert.Contains(queryString, `span_kind = '`+escapedInput+`'`)
+
+			sqlOnly := stripSQLStringLiterals(assert, queryString)
+			assert.NotContains(sqlOnly, "--")
+			assert.NotContains(sqlOnly, ";")
+			assert.NotContains(sqlOnly, "1=1")
+			assert.NotContains(sqlOnly, "UNION")
+			assert.NotContains(sqlOnly, "DROP")
+		})
+	}
+}
+
+func TestFindTracesEscapesTraceIDs(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc := mocks.NewMockAthenaAPI(ctrl)
+
+	var traceIDsQueryString, spansQueryString string
+	mockQueryRunAndCapture(mockSvc, [][]string{{"0000000000000011"}, {"x') OR ('1'='1"}}, &traceIDsQueryString)
+	mockQueryRunAndCapture(mockSvc, [][]string{}, &spansQueryString)
+
+	reader := NewTestReader(ctx, assert, mockSvc)
+
+	traces, err := reader.FindTraces(ctx, &spanstore.TraceQueryParameters{ServiceName: "test", NumTraces: 20})
+	assert.NoError(err)
+	assert.Empty(traces)
+
+	assert.Contains(spansQueryString, `trace_id IN ('0000000000000011', 'x'') OR (''1''=''1')`)
+	assert.NotContains(stripSQLStringLiterals(assert, spansQueryString), "OR")
+}
+
+func TestGetTraceDecodesSpanPayloads(t *testing.T) {
+	// base64 encoded payload as written before the schema version was introduced
+	legacyPayload := "/wYAAHNOYVBwWQBZAAB5D7oLeggKEAA2AQAIERIIDRGwAxoTZXhhbXBsZS1vcGVyYXRpb24tMTIMCOfPqMQFELjvjrECOgQQoI0GSg4KMhYAAEo6EAAMUhMKERFLIHNlcnZpY2UtMQ=="
+
+	span := NewTestSpan(assert.New(t))
+	spanRecord, err := NewSpanRecordFromSpan(span, nil)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		schemaVersion string
+		payload       string
+	}{
+		{name: "without schema version", schemaVersion: "", payload: legacyPayload},
+		{name: "base64 payload", schemaVersion: "1", payload: legacyPayload},
+		{name: "binary payload", schemaVersion: "2", payload: spanRecord.SpanPayload},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			assert := assert.New(t)
+			ctx := context.TODO()
+
+			mockSvc := mocks.NewMockAthenaAPI(ctrl)
+
+			var queryString string
+			mockQueryRunAndCapture(mockSvc, [][]string{{tt.schemaVersion, toAthenaVarbinary(tt.payload)}}, &queryString)
+
+			reader := NewTestReader(ctx, assert, mockSvc)
+			defer reader.Close()
+
+			trace, err := reader.GetTrace(ctx, span.TraceID)
+			assert.NoError(err)
+			assert.Len(trace.Spans, 1)
+			assert.Equal(span.SpanID, trace.Spans[0].SpanID)
+			assert.Equal("example-operation-1", trace.Spans[0].OperationName)
+			assert.Contains(queryString, "SELECT DISTINCT schema_version, span_payload")
+		})
+	}
+}
+
+func TestFindTraceIDsAthenaTagCondition(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc := mocks.NewMockAthenaAPI(ctrl)
+
+	var queryString string
+	mockQueryRunAndCapture(mockSvc, [][]string{}, &queryString)
+
+	reader := NewTestReader(ctx, assert, mockSvc)
+
+	_, err := reader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+		ServiceName: "service",
+		Tags:        map[string]string{"http.status_code": "500"},
+		NumTraces:   20,
+	})
+	assert.NoError(err)
+
+	// Athena engine version 3 fails queries accessing missing map keys using a subscript
+	assert.Contains(queryString, `((element_at(span_tags, 'http.status_code') = '500' OR element_at(process_tags, 'http.status_code') = '500' OR element_at(tags, 'http.status_code') = '500' OR cardinality(filter(logs, log -> element_at(log.fields, 'http.status_code') = '500')) > 0) OR element_at(int_tags, 'http.status_code') = 500)`)
+	assert.NotContains(queryString, `['http.status_code']`)
+}
+
+func TestFindTraceIDsTypedTags(t *testing.T) {
+	tests := []struct {
+		value     string
+		condition string
+	}{
+		{value: "GET", condition: `(element_at(span_tags, 'tag') = 'GET' OR element_at(process_tags, 'tag') = 'GET' OR element_at(tags, 'tag') = 'GET' OR cardinality(filter(logs, log -> element_at(log.fields, 'tag') = 'GET')) > 0)`},
+		{value: "500", condition: `element_at(tags, 'tag') = '500' OR cardinality(filter(logs, log -> element_at(log.fields, 'tag') = '500')) > 0) OR element_at(int_tags, 'tag') = 500)`},
+		{value: "72.50", condition: `element_at(tags, 'tag') = '72.50' OR cardinality(filter(logs, log -> element_at(log.fields, 'tag') = '72.50')) > 0) OR element_at(float_tags, 'tag') = 72.5)`},
+		{value: "true", condition: `element_at(tags, 'tag') = 'true' OR cardinality(filter(logs, log -> element_at(log.fields, 'tag') = 'true')) > 0) OR element_at(bool_tags, 'tag') = true)`},
+		{value: ">=500", condition: `(element_at(int_tags, 'tag') >= 500 OR element_at(float_tags, 'tag') >= 500)`},
+		{value: "< 0.5", condition: `(element_at(int_tags, 'tag') < 0.5 OR element_at(float_tags, 'tag') < 0.5)`},
+		{value: ">NaN", condition: `element_at(span_tags, 'tag') = '>NaN'`},
+		{value: ">' OR 1=1", condition: `element_at(span_tags, 'tag') = '>'' OR 1=1'`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.value, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			assert := assert.New(t)
+			ctx := context.TODO()
+
+			mockSvc := mocks.NewMockAthenaAPI(ctrl)
+
+			var queryString string
+			mockQueryRunAndCapture(mockSvc, [][]string{}, &queryString)
+
+			reader := NewTestReader(ctx, assert, mockSvc)
+
+			_, err := reader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+				ServiceName: "service",
+				Tags:        map[string]string{"tag": tt.value},
+				NumTraces:   20,
+			})
+			assert.NoError(err)
+
+			assert.Contains(queryString, tt.condition)
+		})
+	}
+}
+
+func TestFindTraceIDsPromotedTags(t *testing.T) {
+	tests := []struct {
+		name      string
+		tags      map[string]string
+		condition string
+	}{
+		{
+			name:      "string",
+			tags:      map[string]string{"k8s.namespace": "prod"},
+			condition: `(tag_k8s_namespace = 'prod' OR (element_at(span_tags, 'k8s.namespace') = 'prod' OR element_at(process_tags, 'k8s.namespace') = 'prod' OR element_at(tags, 'k8s.namespace') = 'prod' OR cardinality(filter(logs, log -> element_at(log.fields, 'k8s.namespace') = 'prod')) > 0))`,
+		},
+		{
+			name:      "integer",
+			tags:      map[string]string{"http.status_code": "500"},
+			condition: `((tag_http_status_code = '500' OR (element_at(span_tags, 'http.status_code') = '500' OR element_at(process_tags, 'http.status_code') = '500' OR element_at(tags, 'http.status_code') = '500' OR cardinality(filter(logs, log -> element_at(log.fields, 'http.status_code') = '500')) > 0)) OR element_at(int_tags, 'http.status_code') = 500)`,
+		},
+		{
+			name:      "boolean",
+			tags:      map[string]string{"error": "true"},
+			condition: `((tag_error = 'true' OR (element_at(span_tags, 'error') = 'true' OR element_at(process_tags, 'error') = 'true' OR element_at(tags, 'error') = 'true' OR cardinality(filter(logs, log -> element_at(log.fields, 'error') = 'true')) > 0)) OR element_at(bool_tags, 'error') = true)`,
+		},
+		{
+			// Comparisons only match the typed span tags, like without promoting the tag
+			name:      "comparison",
+			tags:      map[string]string{"http.status_code": ">=500"},
+			condition: `(element_at(int_tags, 'http.status_code') >= 500 OR element_at(float_tags, 'http.status_code') >= 500)`,
+		},
+		{
+			name:      "not promoted",
+			tags:      map[string]string{"http.method": "GET"},
+			condition: `(element_at(span_tags, 'http.method') = 'GET' OR element_at(process_tags, 'http.method') = 'GET' OR element_at(tags, 'http.method') = 'GET' OR cardinality(filter(logs, log -> element_at(log.fields, 'http.method') = 'GET')) > 0)`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			assert := assert.New(t)
+			ctx := context.TODO()
+
+			mockSvc := mocks.NewMockAthenaAPI(ctrl)
+
+			var queryString string
+			mockQueryRunAndCapture(mockSvc, [][]string{}, &queryString)
+
+			reader, err := NewReader(ctx, hclog.NewNullLogger(), metrics.NullFactory, mockSvc, config.Athena{
+				SpansTableName:      "jaeger_spans",
+				OperationsTableName: "jaeger_operations",
+				MaxSpanAge:          "336h",
+			}, PartitionScheme{}, []string{"k8s.namespace", "http.status_code", "error"})
+			assert.NoError(err)
+			defer reader.Close()
+
+			_, err = reader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+				ServiceName: "service",
+				Tags:        tt.tags,
+				NumTraces:   20,
+			})
+			assert.NoError(err)
+
+			assert.Contains(queryString, tt.condition)
+		})
+	}
+}
+
+func TestFindTraceIDsRootSpans(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc := mocks.NewMockAthenaAPI(ctrl)
+
+	var queryString string
+	mockQueryRunAndCapture(mockSvc, [][]string{}, &queryString)
+
+	reader := NewTestReader(ctx, assert, mockSvc)
+	defer reader.Close()
+
+	_, err := reader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+		ServiceName: "service",
+		Tags:        map[string]string{"jaeger-s3.root": "true"},
+		NumTraces:   20,
+	})
+	assert.NoError(err)
+
+	assert.Contains(queryString, `(CASE WHEN COALESCE(schema_version, 1) >= 3 THEN is_root ELSE NOT cardinality(filter("references", reference -> reference.ref_type = 0 AND reference.trace_id = trace_id)) > 0 END)`)
+	assert.NotContains(queryString, `span_tags`)
+}
+
+func TestFindTraceIDsRootSpansInvalidValue(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	reader := NewTestReader(ctx, assert, mocks.NewMockAthenaAPI(ctrl))
+	defer reader.Close()
+
+	_, err := reader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+		ServiceName: "service",
+		Tags:        map[string]string{"jaeger-s3.root": "yes"},
+		NumTraces:   20,
+	})
+	assert.ErrorContains(err, `invalid value "yes" of jaeger-s3.root, expected true or false`)
+}
+
+func TestFindTraceIDsIsRootTag(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc := mocks.NewMockAthenaAPI(ctrl)
+
+	var queryString string
+	mockQueryRunAndCapture(mockSvc, [][]string{}, &queryString)
+
+	reader := NewTestReader(ctx, assert, mockSvc)
+	defer reader.Close()
+
+	// A span tag named is_root is searched like any other tag
+	_, err := reader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+		ServiceName: "service",
+		Tags:        map[string]string{"is_root": "true"},
+		NumTraces:   20,
+	})
+	assert.NoError(err)
+
+	assert.Contains(queryString, `element_at(span_tags, 'is_root') = 'true'`)
+	assert.NotContains(queryString, `THEN is_root`)
+}
+
+func TestReaderConflictingPromotedTags(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewReaderWithQueryEngine(context.TODO(), hclog.NewNullLogger(), nil, config.Athena{
+		MaxSpanAge: "336h",
+	}, PartitionScheme{}, []string{"http.method", "http_method"})
+	assert.ErrorContains(err, `promoted tags "http.method" and "http_method" are both written into the column tag_http_method`)
+}
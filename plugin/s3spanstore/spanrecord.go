@@ -4,27 +4,58 @@ import (
 	"bytes"
 	"encoding/base64"
 	"fmt"
+	"strconv"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
 	"github.com/jaegertracing/jaeger/model"
 )
 
-// SpanRecord contains queryable properties from the span and the span as json payload
+const (
+	// Files written before the schema version was introduced don't contain the schema_version
+	// column and store the span payload as base64 encoded string.
+	SCHEMA_VERSION_BASE64_PAYLOAD = 1
+	// The span payload is stored as binary
+	SCHEMA_VERSION_BINARY_PAYLOAD = 2
+	// The parent span id, root flag and whether a span has references other than its parent are stored
+	SCHEMA_VERSION_PARENT_SPAN_ID = 3
+
+	SCHEMA_VERSION = SCHEMA_VERSION_PARENT_SPAN_ID
+)
+
+// SpanRecord contains queryable properties from the span and the span as snappy compressed protobuf payload
 type SpanRecord struct {
 	TraceID       string `parquet:"name=trace_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN"`
 	SpanID        string `parquet:"name=span_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN"`
 	OperationName string `parquet:"name=operation_name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
 	SpanKind      string `parquet:"name=span_kind, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
 	// StartTime must have millisecond precision to work with Athena engine version 3.
-	StartTime   int64             `parquet:"name=start_time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
-	Duration    int64             `parquet:"name=duration, type=INT64"`
+	StartTime int64 `parquet:"name=start_time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Duration  int64 `parquet:"name=duration, type=INT64"`
+	// Tags contains span tags, process tags and log fields merged and is only written by previous versions
 	Tags        map[string]string `parquet:"name=tags, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
 	ServiceName string            `parquet:"name=service_name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
 
-	// TODO: Write binary
-	SpanPayload string                 `parquet:"name=span_payload, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN"`
-	References  []SpanRecordReferences `parquet:"name=references"`
+	SpanTags    map[string]string `parquet:"name=span_tags, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	ProcessTags map[string]string `parquet:"name=process_tags, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	Logs        []SpanRecordLog   `parquet:"name=logs"`
+
+	// Numeric and boolean span tags are additionally stored with their type, so they can be compared.
+	// Process tags and log fields aren't included, so they can't overwrite span tags of the same key.
+	IntTags   map[string]int64   `parquet:"name=int_tags, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=INT64"`
+	FloatTags map[string]float64 `parquet:"name=float_tags, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=DOUBLE"`
+	BoolTags  map[string]bool    `parquet:"name=bool_tags, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=BOOLEAN"`
+
+	// ParentSpanID is the span referenced as child of within the same trace, it is empty for root spans.
+	// HasOtherReferences is set, when the references contain more than the parent span.
+	ParentSpanID       string `parquet:"name=parent_span_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN"`
+	IsRoot             bool   `parquet:"name=is_root, type=BOOLEAN"`
+	HasOtherReferences bool   `parquet:"name=has_other_references, type=BOOLEAN"`
+
+	// SpanPayload contains binary data, which isn't valid UTF8
+	SpanPayload   string                 `parquet:"name=span_payload, type=BYTE_ARRAY, encoding=PLAIN"`
+	References    []SpanRecordReferences `parquet:"name=references"`
+	SchemaVersion int32                  `parquet:"name=schema_version, type=INT32"`
 }
 
 type SpanRecordReferences struct {
@@ -33,6 +64,24 @@ type SpanRecordReferences struct {
 	RefType int32  `parquet:"name=ref_type, type=INT32, convertedtype=INT_8"`
 }
 
+type SpanRecordLog struct {
+	Timestamp int64             `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Fields    map[string]string `parquet:"name=fields, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+}
+
+func NewSpanRecordLogsFromSpanLogs(span *model.Span, tagFilter *TagFilter) []SpanRecordLog {
+	spanRecordLogs := make([]SpanRecordLog, len(span.Logs))
+
+	for i, v := range span.Logs {
+		spanRecordLogs[i] = SpanRecordLog{
+			Timestamp: v.Timestamp.UnixMilli(),
+			Fields:    kvToMap(tagFilter.Filter(v.Fields)),
+		}
+	}
+
+	return spanRecordLogs
+}
+
 func NewSpanRecordReferencesFromSpanReferences(span *model.Span) []SpanRecordReferences {
 	spanRecordReferences := make([]SpanRecordReferences, len(span.References))
 
@@ -47,44 +96,48 @@ func NewSpanRecordReferencesFromSpanReferences(span *model.Span) []SpanRecordRef
 	return spanRecordReferences
 }
 
-func EncodeSpanPayload(span *model.Span) (string, error) {
+func EncodeSpanPayload(span *model.Span) ([]byte, error) {
 	spanBytes, err := proto.Marshal(span)
 	if err != nil {
-		return "", fmt.Errorf("failed to serialize item: %w", err)
+		return nil, fmt.Errorf("failed to serialize item: %w", err)
 	}
 
 	var b bytes.Buffer
-	b64 := base64.NewEncoder(base64.StdEncoding, &b)
-	sn := snappy.NewBufferedWriter(b64)
+	sn := snappy.NewBufferedWriter(&b)
 
 	_, err = sn.Write(spanBytes)
 	if err != nil {
-		return "", fmt.Errorf("failed to write compress span: %w", err)
+		return nil, fmt.Errorf("failed to write compress span: %w", err)
 	}
 
 	if err = sn.Close(); err != nil {
-		return "", fmt.Errorf("failed to close compress span: %w", err)
+		return nil, fmt.Errorf("failed to close compress span: %w", err)
 	}
 
-	if err = b64.Close(); err != nil {
-		return "", fmt.Errorf("failed to base64 span: %w", err)
-	}
-
-	return b.String(), nil
+	return b.Bytes(), nil
 }
 
-func DecodeSpanPayload(payload string) (*model.Span, error) {
-	payloadBytes, err := base64.StdEncoding.DecodeString(payload)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode payload: %w", err)
+// DecodeSpanPayloadWithSchemaVersion decodes a span payload written using the given schema version.
+// An empty schema version refers to files written before the schema version was introduced.
+func DecodeSpanPayloadWithSchemaVersion(schemaVersion string, payload []byte) (*model.Span, error) {
+	if schemaVersion == "" || schemaVersion == strconv.Itoa(SCHEMA_VERSION_BASE64_PAYLOAD) {
+		decodedPayload, err := base64.StdEncoding.DecodeString(string(payload))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode payload: %w", err)
+		}
+
+		payload = decodedPayload
 	}
 
-	b := bytes.NewBuffer(payloadBytes)
+	return DecodeSpanPayload(payload)
+}
+
+func DecodeSpanPayload(payload []byte) (*model.Span, error) {
+	b := bytes.NewBuffer(payload)
 	r := snappy.NewReader(b)
 
 	var resB bytes.Buffer
-	_, err = resB.ReadFrom(r)
-	if err != nil {
+	if _, err := resB.ReadFrom(r); err != nil {
 		return nil, fmt.Errorf("failed to decompress payload: %w", err)
 	}
 
@@ -95,12 +148,11 @@ func DecodeSpanPayload(payload string) (*model.Span, error) {
 	return span, nil
 }
 
-func NewSpanRecordFromSpan(span *model.Span) (*SpanRecord, error) {
-	searchableTags := append([]model.KeyValue{}, span.Tags...)
-	searchableTags = append(searchableTags, span.Process.Tags...)
-	for _, log := range span.Logs {
-		searchableTags = append(searchableTags, log.Fields...)
-	}
+// NewSpanRecordFromSpan creates the record of a span, only key values passing the tag filter are
+// searchable. The tag filter can be nil.
+func NewSpanRecordFromSpan(span *model.Span, tagFilter *TagFilter) (*SpanRecord, error) {
+	spanTags := tagFilter.Filter(span.Tags)
+	processTags := tagFilter.Filter(span.Process.Tags)
 
 	spanPayload, err := EncodeSpanPayload(span)
 	if err != nil {
@@ -109,6 +161,15 @@ func NewSpanRecordFromSpan(span *model.Span) (*SpanRecord, error) {
 
 	kind, _ := span.GetSpanKind()
 
+	parentSpanID := ""
+	otherReferences := len(span.References)
+	if parentID := span.ParentSpanID(); parentID != 0 {
+		parentSpanID = parentID.String()
+		otherReferences--
+	}
+
+	intTags, floatTags, boolTags := kvToTypedMaps(spanTags)
+
 	return &SpanRecord{
 		TraceID:       span.TraceID.String(),
 		SpanID:        span.SpanID.String(),
@@ -116,13 +177,32 @@ func NewSpanRecordFromSpan(span *model.Span) (*SpanRecord, error) {
 		SpanKind:      kind,
 		StartTime:     span.StartTime.UnixMilli(),
 		Duration:      span.Duration.Nanoseconds(),
-		Tags:          kvToMap(searchableTags),
+		SpanTags:      kvToMap(spanTags),
+		ProcessTags:   kvToMap(processTags),
+		Logs:          NewSpanRecordLogsFromSpanLogs(span, tagFilter),
+		IntTags:       intTags,
+		FloatTags:     floatTags,
+		BoolTags:      boolTags,
 		ServiceName:   span.Process.ServiceName,
-		SpanPayload:   spanPayload,
+		SpanPayload:   string(spanPayload),
 		References:    NewSpanRecordReferencesFromSpanReferences(span),
+		SchemaVersion: SCHEMA_VERSION,
+
+		ParentSpanID:       parentSpanID,
+		IsRoot:             parentSpanID == "",
+		HasOtherReferences: otherReferences > 0,
 	}, nil
 }
 
+// SortKey orders spans by trace id and start time
+func (r *SpanRecord) SortKey() (string, int64) {
+	return r.TraceID, r.StartTime
+}
+
+func (r *SpanRecord) PartitionServiceName() string {
+	return r.ServiceName
+}
+
 func kvToMap(kvs []model.KeyValue) map[string]string {
 	kvMap := map[string]string{}
 	for _, field := range kvs {
@@ -131,3 +211,23 @@ func kvToMap(kvs []model.KeyValue) map[string]string {
 
 	return kvMap
 }
+
+// kvToTypedMaps returns the int64, float64 and bool key values by key
+func kvToTypedMaps(kvs []model.KeyValue) (map[string]int64, map[string]float64, map[string]bool) {
+	intMap := map[string]int64{}
+	floatMap := map[string]float64{}
+	boolMap := map[string]bool{}
+
+	for _, field := range kvs {
+		switch field.VType {
+		case model.Int64Type:
+			intMap[field.Key] = field.Int64()
+		case model.Float64Type:
+			floatMap[field.Key] = field.Float64()
+		case model.BoolType:
+			boolMap[field.Key] = field.Bool()
+		}
+	}
+
+	return intMap, floatMap, boolMap
+}
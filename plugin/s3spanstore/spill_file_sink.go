@@ -0,0 +1,324 @@
+package s3spanstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/hashicorp/go-hclog"
+	"github.com/uber/jaeger-lib/metrics"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+const (
+	spillRetryInitialBackoff = time.Second
+	spillRetryMaxBackoff     = 5 * time.Minute
+	spillTemporarySuffix     = ".tmp"
+	// Every spillRetryWarnInterval failed retry of a file is logged as warning
+	spillRetryWarnInterval = 10
+)
+
+// errParquetFileSpilled is returned when closing a file, which failed to upload and stays in the spill directory
+var errParquetFileSpilled = errors.New("parquet file spilled")
+
+// SpillParquetFileSink writes parquet files into a local spill directory and uploads them to S3
+// once completed. Files failing to upload stay in the spill directory and are retried with backoff
+// in the background. Files still spilled on shutdown are replayed on the next startup.
+type SpillParquetFileSink struct {
+	logger     hclog.Logger
+	metrics    *SpillMetrics
+	svc        S3API
+	bucketName string
+	directory  string
+
+	retryInitialBackoff time.Duration
+	retryMaxBackoff     time.Duration
+
+	// ctx is cancelled on close, stopping pending retries
+	ctx     context.Context
+	cancel  context.CancelFunc
+	retries sync.WaitGroup
+}
+
+func NewSpillParquetFileSink(logger hclog.Logger, metricsFactory metrics.Factory, svc S3API, bucketName string, directory string) (*SpillParquetFileSink, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create spill directory: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &SpillParquetFileSink{
+		logger:              logger,
+		metrics:             newSpillMetrics(metricsFactory),
+		svc:                 svc,
+		bucketName:          bucketName,
+		directory:           directory,
+		retryInitialBackoff: spillRetryInitialBackoff,
+		retryMaxBackoff:     spillRetryMaxBackoff,
+		ctx:                 ctx,
+		cancel:              cancel,
+	}, nil
+}
+
+// spillPath returns the local path of a key. Keys are escaped into a flat directory, so
+// they can be restored exactly when replaying.
+func (s *SpillParquetFileSink) spillPath(key string) string {
+	return filepath.Join(s.directory, url.PathEscape(key))
+}
+
+func (s *SpillParquetFileSink) CreateFile(ctx context.Context, key string) (source.ParquetFile, error) {
+	path := s.spillPath(key)
+
+	file, err := local.NewLocalFileWriter(path + spillTemporarySuffix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spill file: %w", err)
+	}
+
+	return &spillParquetFile{ParquetFile: file, ctx: ctx, sink: s, key: key, path: path}, nil
+}
+
+func (s *SpillParquetFileSink) Empty(ctx context.Context) error {
+	return EmptyBucket(ctx, s.svc, s.bucketName)
+}
+
+// Replay uploads files spilled before the last shutdown in the background. Temporary files
+// of parquet files, which never got completed, are removed.
+func (s *SpillParquetFileSink) Replay() error {
+	entries, err := os.ReadDir(s.directory)
+	if err != nil {
+		return fmt.Errorf("failed to read spill directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		path := filepath.Join(s.directory, entry.Name())
+
+		if strings.HasSuffix(entry.Name(), spillTemporarySuffix) {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("failed to remove incomplete spill file: %w", err)
+			}
+			continue
+		}
+
+		key, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			s.logger.Warn("ignoring unknown file in spill directory", "file", entry.Name())
+			continue
+		}
+
+		s.logger.Info("replaying spilled parquet file", "key", key)
+		s.metrics.FilesSpilled.Inc(1)
+		s.retry(key, path, 0, nil)
+	}
+
+	return nil
+}
+
+// Close stops retrying spilled files, they will be replayed on the next startup
+func (s *SpillParquetFileSink) Close() error {
+	s.cancel()
+	s.retries.Wait()
+
+	return nil
+}
+
+// upload uploads a completed spill file and retries in the background on failure. Returns
+// errParquetFileSpilled, when the file stays in the spill directory.
+func (s *SpillParquetFileSink) upload(ctx context.Context, key string, path string, onUploaded func()) error {
+	err := s.uploadFile(ctx, key, path)
+	if err == nil {
+		return nil
+	}
+
+	s.metrics.FilesSpilled.Inc(1)
+
+	if !isRetryableSpillError(err) {
+		s.giveUp(key, err)
+
+		if errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return fmt.Errorf("%w: %w", errParquetFileSpilled, err)
+	}
+
+	s.logger.Warn("failed to upload parquet file, retrying from spill directory", "key", key, "error", err)
+	s.retry(key, path, s.retryInitialBackoff, onUploaded)
+
+	return fmt.Errorf("%w: %w", errParquetFileSpilled, err)
+}
+
+// giveUp stops uploading a spilled file. Files still present are replayed on the next startup.
+func (s *SpillParquetFileSink) giveUp(key string, err error) {
+	s.metrics.FilesFailed.Inc(1)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		s.logger.Error("spill file is missing, parquet file is lost", "key", key, "error", err)
+		return
+	}
+
+	s.logger.Error("failed to upload spilled parquet file, retrying on next startup", "key", key, "error", err)
+}
+
+func (s *SpillParquetFileSink) uploadFile(ctx context.Context, key string, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open spill file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := manager.NewUploader(s.svc).Upload(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+		Body:   file,
+	}); err != nil {
+		return fmt.Errorf("failed to upload spill file: %w", err)
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove uploaded spill file: %w", err)
+	}
+
+	return nil
+}
+
+// retry uploads a spilled file in the background, onUploaded is called once the upload succeeded and can be nil
+func (s *SpillParquetFileSink) retry(key string, path string, backoff time.Duration, onUploaded func()) {
+	s.retries.Add(1)
+	go func() {
+		defer s.retries.Done()
+
+		attempts := 0
+		for {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-s.ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			if err := s.uploadFile(s.ctx, key, path); err != nil {
+				if s.ctx.Err() != nil {
+					return
+				}
+
+				s.metrics.RetryErrors.Inc(1)
+
+				if !isRetryableSpillError(err) {
+					s.giveUp(key, err)
+					return
+				}
+
+				attempts++
+				if attempts == 1 || attempts%spillRetryWarnInterval == 0 {
+					s.logger.Warn("failed to upload spilled parquet file", "key", key, "attempts", attempts, "error", err)
+				} else {
+					s.logger.Debug("failed to upload spilled parquet file", "key", key, "attempts", attempts, "error", err)
+				}
+
+				backoff = nextSpillRetryBackoff(backoff, s.retryInitialBackoff, s.retryMaxBackoff)
+				continue
+			}
+
+			s.metrics.FilesRecovered.Inc(1)
+			s.logger.Info("uploaded spilled parquet file", "key", key)
+			if onUploaded != nil {
+				onUploaded()
+			}
+			return
+		}
+	}()
+}
+
+// isRetryableSpillError returns whether uploading a spill file can succeed when retried. Missing spill
+// files as well as denied uploads or missing buckets aren't retried.
+func isRetryableSpillError(err error) bool {
+	if errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "AccessDenied", "AllAccessDisabled", "InvalidAccessKeyId", "NoSuchBucket", "SignatureDoesNotMatch":
+			return false
+		}
+	}
+
+	var responseErr *awshttp.ResponseError
+	if errors.As(err, &responseErr) && responseErr.HTTPStatusCode() == http.StatusForbidden {
+		return false
+	}
+
+	return true
+}
+
+func nextSpillRetryBackoff(backoff time.Duration, initialBackoff time.Duration, maxBackoff time.Duration) time.Duration {
+	if backoff < initialBackoff {
+		return initialBackoff
+	}
+
+	backoff *= 2
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+
+	return backoff
+}
+
+// spillParquetFile is a local parquet file, which is uploaded on close
+type spillParquetFile struct {
+	source.ParquetFile
+	ctx  context.Context
+	sink *SpillParquetFileSink
+	key  string
+	path string
+
+	onUploaded func()
+}
+
+func (f *spillParquetFile) OnUploaded(onUploaded func()) {
+	f.onUploaded = onUploaded
+}
+
+func (f *spillParquetFile) Close() error {
+	if err := f.ParquetFile.Close(); err != nil {
+		os.Remove(f.path + spillTemporarySuffix)
+		return fmt.Errorf("failed to close spill file: %w", err)
+	}
+
+	if err := os.Rename(f.path+spillTemporarySuffix, f.path); err != nil {
+		return fmt.Errorf("failed to complete spill file: %w", err)
+	}
+
+	// Failed uploads are retried from the spill directory, so the data isn't lost
+	return f.sink.upload(f.ctx, f.key, f.path, f.onUploaded)
+}
+
+// Abort removes the partially written spill file
+func (f *spillParquetFile) Abort() error {
+	closeErr := f.ParquetFile.Close()
+
+	if err := os.Remove(f.path + spillTemporarySuffix); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", f.path+spillTemporarySuffix, err)
+	}
+
+	return closeErr
+}
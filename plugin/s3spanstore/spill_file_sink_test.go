@@ -0,0 +1,209 @@
+package s3spanstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/golang/mock/gomock"
+	"github.com/hashicorp/go-hclog"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-lib/metrics"
+	"github.com/uber/jaeger-lib/metrics/metricstest"
+)
+
+func NewTestSpillParquetFileSink(assert *assert.Assertions, metricsFactory metrics.Factory, mockSvc *mocks.MockS3API, directory string) *SpillParquetFileSink {
+	logger := hclog.New(&hclog.LoggerOptions{
+		Level:      hclog.Debug,
+		Name:       "jaeger-s3",
+		JSONFormat: true,
+	})
+
+	sink, err := NewSpillParquetFileSink(logger, metricsFactory, mockSvc, "jaeger-spans", directory)
+	assert.NoError(err)
+
+	sink.retryInitialBackoff = time.Millisecond
+	sink.retryMaxBackoff = time.Millisecond
+
+	return sink
+}
+
+// putObjectBodies records the bodies of uploaded objects by key
+func putObjectBodies(assert *assert.Assertions, bodies map[string]string) func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	return func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+		body, err := io.ReadAll(input.Body)
+		assert.NoError(err)
+
+		bodies[aws.ToString(input.Key)] = string(body)
+
+		return &s3.PutObjectOutput{}, nil
+	}
+}
+
+func TestSpillParquetFileSinkRetriesFailedUpload(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	bodies := map[string]string{}
+	gomock.InOrder(
+		mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, errors.New("service unavailable")).Times(2),
+		mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(putObjectBodies(assert, bodies)),
+	)
+
+	directory := t.TempDir()
+	metricsFactory := metricstest.NewFactory(0)
+	sink := NewTestSpillParquetFileSink(assert, metricsFactory, mockSvc, directory)
+
+	file, err := sink.CreateFile(ctx, "/spans/2017/01/26/16/file.parquet")
+	assert.NoError(err)
+
+	_, err = file.Write([]byte("parquet"))
+	assert.NoError(err)
+
+	// The failed upload is retried in the background
+	uploaded := make(chan struct{})
+	file.(SpillableParquetFile).OnUploaded(func() { close(uploaded) })
+	assert.ErrorIs(file.Close(), errParquetFileSpilled)
+	<-uploaded
+
+	assert.Eventually(func() bool {
+		entries, err := os.ReadDir(directory)
+		return err == nil && len(entries) == 0
+	}, time.Second, time.Millisecond)
+
+	assert.NoError(sink.Close())
+
+	assert.Equal(map[string]string{"/spans/2017/01/26/16/file.parquet": "parquet"}, bodies)
+	metricsFactory.AssertCounterMetrics(t,
+		metricstest.ExpectedMetric{Name: "spill_files", Value: 1},
+		metricstest.ExpectedMetric{Name: "spill_files_recovered", Value: 1},
+		metricstest.ExpectedMetric{Name: "spill_retry_errors", Value: 1},
+	)
+}
+
+func TestSpillParquetFileSinkReplay(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+
+	assert := assert.New(t)
+
+	bodies := map[string]string{}
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(putObjectBodies(assert, bodies))
+
+	directory := t.TempDir()
+	spilledPath := filepath.Join(directory, url.PathEscape("spans/2017/01/26/16/spilled.parquet"))
+	assert.NoError(os.WriteFile(spilledPath, []byte("spilled"), 0644))
+	incompletePath := filepath.Join(directory, url.PathEscape("spans/2017/01/26/16/incomplete.parquet")+".tmp")
+	assert.NoError(os.WriteFile(incompletePath, []byte("incomplete"), 0644))
+
+	sink := NewTestSpillParquetFileSink(assert, metrics.NullFactory, mockSvc, directory)
+	assert.NoError(sink.Replay())
+
+	assert.Eventually(func() bool {
+		entries, err := os.ReadDir(directory)
+		return err == nil && len(entries) == 0
+	}, time.Second, time.Millisecond)
+
+	assert.NoError(sink.Close())
+
+	assert.Equal(map[string]string{"spans/2017/01/26/16/spilled.parquet": "spilled"}, bodies)
+}
+
+func TestSpillParquetFileSinkKeepsFilesOnClose(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, errors.New("service unavailable")).MinTimes(1)
+
+	directory := t.TempDir()
+	sink := NewTestSpillParquetFileSink(assert, metrics.NullFactory, mockSvc, directory)
+	sink.retryInitialBackoff = time.Hour
+
+	file, err := sink.CreateFile(ctx, "spans/2017/01/26/16/file.parquet")
+	assert.NoError(err)
+	assert.ErrorIs(file.Close(), errParquetFileSpilled)
+
+	assert.NoError(sink.Close())
+
+	// The spilled file is kept for the next startup
+	entries, err := os.ReadDir(directory)
+	assert.NoError(err)
+	assert.Len(entries, 1)
+	assert.Equal(url.PathEscape("spans/2017/01/26/16/file.parquet"), entries[0].Name())
+}
+
+func TestSpillParquetFileSinkStopsRetryingPermanentErrors(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+
+	assert := assert.New(t)
+
+	gomock.InOrder(
+		mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, errors.New("service unavailable")),
+		mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, &smithy.GenericAPIError{Code: "AccessDenied", Message: "Access Denied"}),
+	)
+
+	directory := t.TempDir()
+	assert.NoError(os.WriteFile(filepath.Join(directory, url.PathEscape("spans/2017/01/26/16/denied.parquet")), []byte("denied"), 0644))
+
+	metricsFactory := metricstest.NewFactory(0)
+	sink := NewTestSpillParquetFileSink(assert, metricsFactory, mockSvc, directory)
+	assert.NoError(sink.Replay())
+
+	// The retry gives up, so close doesn't need to cancel it
+	sink.retries.Wait()
+	assert.NoError(sink.Close())
+
+	// The spilled file is kept for the next startup
+	entries, err := os.ReadDir(directory)
+	assert.NoError(err)
+	assert.Len(entries, 1)
+
+	metricsFactory.AssertCounterMetrics(t,
+		metricstest.ExpectedMetric{Name: "spill_retry_errors", Value: 2},
+		metricstest.ExpectedMetric{Name: "spill_files_failed", Value: 1},
+	)
+}
+
+func TestSpillParquetFileSinkStopsRetryingMissingFiles(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+
+	assert := assert.New(t)
+
+	metricsFactory := metricstest.NewFactory(0)
+	sink := NewTestSpillParquetFileSink(assert, metricsFactory, mockSvc, t.TempDir())
+
+	sink.retry("spans/2017/01/26/16/removed.parquet", sink.spillPath("spans/2017/01/26/16/removed.parquet"), 0, nil)
+	sink.retries.Wait()
+	assert.NoError(sink.Close())
+
+	metricsFactory.AssertCounterMetrics(t,
+		metricstest.ExpectedMetric{Name: "spill_files_failed", Value: 1},
+	)
+}
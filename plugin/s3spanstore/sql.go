@@ -0,0 +1,28 @@
+package s3spanstore
+
+import (
+	"strings"
+)
+
+// sqlString returns value as a single quoted SQL string literal. Embedded
+// single quotes are doubled, which is the only escape sequence Athena (Presto/Trino)
+// recognises within string literals, so the value can never terminate the literal early.
+func sqlString(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// sqlStringList returns values as a comma separated list of SQL string literals,
+// suitable to be used within an IN (...) predicate.
+func sqlStringList(values []string) string {
+	literals := make([]string, len(values))
+	for i, value := range values {
+		literals[i] = sqlString(value)
+	}
+
+	return strings.Join(literals, ", ")
+}
+
+// sqlIdentifier returns name as a double quoted SQL identifier.
+func sqlIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,31 @@
+package s3spanstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQLString(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(`'test'`, sqlString("test"))
+	assert.Equal(`''`, sqlString(""))
+	assert.Equal(`'it''s'`, sqlString("it's"))
+	assert.Equal(`''' OR ''1''=''1'`, sqlString("' OR '1'='1"))
+	assert.Equal(`'\'' --'`, sqlString(`\' --`))
+}
+
+func TestSQLStringList(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(`'a', 'b''c'`, sqlStringList([]string{"a", "b'c"}))
+	assert.Equal(``, sqlStringList([]string{}))
+}
+
+func TestSQLIdentifier(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(`"jaeger_spans"`, sqlIdentifier("jaeger_spans"))
+	assert.Equal(`"a""b"`, sqlIdentifier(`a"b`))
+}
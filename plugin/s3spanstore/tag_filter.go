@@ -0,0 +1,78 @@
+package s3spanstore
+
+import (
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+)
+
+// TagFilter decides which tags, process tags and log fields are written into the searchable
+// columns. Filtered key values are still part of the span payload. A nil filter indexes everything.
+type TagFilter struct {
+	indexed        map[string]bool
+	excluded       map[string]bool
+	maxValueLength int
+}
+
+// NewTagFilter returns the filter configured by s3Config or nil, when nothing is filtered
+func NewTagFilter(s3Config config.S3) *TagFilter {
+	if len(s3Config.IndexedTags) == 0 && len(s3Config.ExcludedTags) == 0 && s3Config.MaxTagValueLength <= 0 {
+		return nil
+	}
+
+	f := &TagFilter{maxValueLength: s3Config.MaxTagValueLength}
+
+	if len(s3Config.IndexedTags) > 0 {
+		f.indexed = stringSet(s3Config.IndexedTags)
+	}
+	if len(s3Config.ExcludedTags) > 0 {
+		f.excluded = stringSet(s3Config.ExcludedTags)
+	}
+
+	return f
+}
+
+// Indexed reports whether a key value is written into the searchable columns
+func (f *TagFilter) Indexed(kv model.KeyValue) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.excluded[kv.Key] {
+		return false
+	}
+
+	if f.indexed != nil && !f.indexed[kv.Key] {
+		return false
+	}
+
+	if f.maxValueLength > 0 && (kv.VType == model.StringType || kv.VType == model.BinaryType) && len(kv.AsString()) > f.maxValueLength {
+		return false
+	}
+
+	return true
+}
+
+// Filter returns the indexed key values
+func (f *TagFilter) Filter(kvs []model.KeyValue) []model.KeyValue {
+	if f == nil {
+		return kvs
+	}
+
+	filtered := make([]model.KeyValue, 0, len(kvs))
+	for _, kv := range kvs {
+		if f.Indexed(kv) {
+			filtered = append(filtered, kv)
+		}
+	}
+
+	return filtered
+}
+
+func stringSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+
+	return set
+}
@@ -0,0 +1,50 @@
+package s3spanstore
+
+import (
+	"testing"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTagFilterDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(NewTagFilter(config.S3{}))
+}
+
+func TestSpanRecordWithTagFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	span := NewTestSpan(assert)
+	span.Tags = []model.KeyValue{
+		model.String("http.method", "GET"),
+		model.Int64("http.status_code", 500),
+		model.String("db.statement", "SELECT * FROM users"),
+		model.String("http.url", "https://example.com/a/very/long/path"),
+	}
+	span.Process.Tags = []model.KeyValue{model.String("hostname", "host-1"), model.String("ip", "10.0.0.1")}
+	span.Logs = []model.Log{
+		{Timestamp: span.StartTime, Fields: []model.KeyValue{model.String("event", "retry"), model.String("payload", "{}")}},
+	}
+
+	tagFilter := NewTagFilter(config.S3{
+		IndexedTags:       []string{"http.method", "http.status_code", "db.statement", "http.url", "hostname", "event"},
+		ExcludedTags:      []string{"db.statement"},
+		MaxTagValueLength: 20,
+	})
+
+	spanRecord, err := NewSpanRecordFromSpan(span, tagFilter)
+	assert.NoError(err)
+
+	assert.Equal(map[string]string{"http.method": "GET", "http.status_code": "500"}, spanRecord.SpanTags)
+	assert.Equal(map[string]string{"hostname": "host-1"}, spanRecord.ProcessTags)
+	assert.Equal([]SpanRecordLog{{Timestamp: span.StartTime.UnixMilli(), Fields: map[string]string{"event": "retry"}}}, spanRecord.Logs)
+	assert.Equal(map[string]int64{"http.status_code": 500}, spanRecord.IntTags)
+
+	// The span payload still contains all tags
+	payloadSpan, err := DecodeSpanPayload([]byte(spanRecord.SpanPayload))
+	assert.NoError(err)
+	assert.Equal(span.Tags, payloadSpan.Tags)
+}
@@ -0,0 +1,284 @@
+package s3spanstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/opentracing/opentracing-go"
+	"github.com/uber/jaeger-lib/metrics"
+)
+
+const (
+	TRINO_SOURCE            = "jaeger-s3"
+	TRINO_MAX_BUSY_RETRIES  = 10
+	TRINO_BUSY_RETRY_PERIOD = 100 * time.Millisecond
+	// Starting a query isn't cancelled with the query context, so the query id is known and the
+	// query can be cancelled on the coordinator
+	TRINO_START_TIMEOUT = 30 * time.Second
+)
+
+// TrinoQueryEngine executes queries using a Trino (or Presto) coordinator via the
+// statement HTTP protocol https://trino.io/docs/current/develop/client-protocol.html
+type TrinoQueryEngine struct {
+	logger         hclog.Logger
+	metricsFactory metrics.Factory
+	client         *http.Client
+	cfg            config.Trino
+
+	kindMetrics      map[QueryKind]*TrinoMetrics
+	kindMetricsMutex sync.Mutex
+}
+
+type trinoQueryResults struct {
+	ID      string           `json:"id"`
+	NextURI string           `json:"nextUri"`
+	Data    [][]interface{}  `json:"data"`
+	Error   *trinoQueryError `json:"error"`
+}
+
+type trinoQueryError struct {
+	Message   string `json:"message"`
+	ErrorCode int    `json:"errorCode"`
+	ErrorName string `json:"errorName"`
+	ErrorType string `json:"errorType"`
+}
+
+func (e *trinoQueryError) Error() string {
+	return fmt.Sprintf("%s: %s (%s)", e.ErrorName, e.Message, e.ErrorType)
+}
+
+func NewTrinoQueryEngine(logger hclog.Logger, metricsFactory metrics.Factory, client *http.Client, cfg config.Trino) *TrinoQueryEngine {
+	return &TrinoQueryEngine{
+		logger:         logger,
+		metricsFactory: metricsFactory,
+		client:         client,
+		cfg:            cfg,
+		kindMetrics:    map[QueryKind]*TrinoMetrics{},
+	}
+}
+
+// metrics returns the metrics of queries of the given kind
+func (e *TrinoQueryEngine) metrics(kind QueryKind) *TrinoMetrics {
+	e.kindMetricsMutex.Lock()
+	defer e.kindMetricsMutex.Unlock()
+
+	m, ok := e.kindMetrics[kind]
+	if !ok {
+		m = newTrinoMetrics(e.metricsFactory.Namespace(metrics.NSOptions{Tags: map[string]string{"query_kind": string(kind)}}))
+		e.kindMetrics[kind] = m
+	}
+
+	return m
+}
+
+// Trino fails when accessing keys missing in a map using a subscript, so element_at is used instead
+func (e *TrinoQueryEngine) MapElement(column string, key string) string {
+	return fmt.Sprintf(`element_at(%s, %s)`, column, sqlString(key))
+}
+
+func (e *TrinoQueryEngine) AnyElement(column string, variable string, condition string) string {
+	return fmt.Sprintf(`any_match(%s, %s -> %s)`, column, variable, condition)
+}
+
+// Trino returns varbinary values base64 encoded
+func (e *TrinoQueryEngine) DecodeBinary(value string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(value)
+}
+
+func (e *TrinoQueryEngine) QueryCached(ctx context.Context, kind QueryKind, query string, lookup string, ttl time.Duration) ([]QueryRow, error) {
+	return e.Query(ctx, kind, query)
+}
+
+func (e *TrinoQueryEngine) Query(ctx context.Context, kind QueryKind, query string) ([]QueryRow, error) {
+	otSpan, _ := opentracing.StartSpanFromContext(ctx, "queryTrino")
+	defer otSpan.Finish()
+	otSpan.SetTag("query_kind", string(kind))
+
+	kindMetrics := e.metrics(kind)
+
+	start := time.Now()
+	queryID, rows, err := e.query(ctx, query)
+	duration := time.Since(start)
+	kindMetrics.QueryDuration.Record(duration)
+	kindMetrics.Queries.Inc(1)
+
+	otSpan.SetTag("trino.query_id", queryID)
+
+	if err != nil {
+		kindMetrics.QueryErrors.Inc(1)
+		e.logger.Warn("trino query failed", "queryKind", kind, "queryId", queryID, "duration", duration, "error", err)
+		return nil, err
+	}
+
+	e.logger.Info("trino query completed", "queryKind", kind, "queryId", queryID, "duration", duration, "rows", len(rows))
+
+	return rows, nil
+}
+
+// query executes the query and fetches all results. Queries abandoned due to the context being done
+// are cancelled on the coordinator.
+func (e *TrinoQueryEngine) query(ctx context.Context, query string) (string, []QueryRow, error) {
+	if err := ctx.Err(); err != nil {
+		return "", nil, fmt.Errorf("failed to start trino query: %w", err)
+	}
+
+	startCtx, cancel := context.WithTimeout(context.Background(), TRINO_START_TIMEOUT)
+	defer cancel()
+
+	results, err := e.request(startCtx, http.MethodPost, strings.TrimSuffix(e.cfg.Endpoint, "/")+"/v1/statement", []byte(query))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to start trino query: %w", err)
+	}
+	queryID := results.ID
+
+	rows := []QueryRow{}
+	for {
+		if results.Error != nil {
+			return queryID, nil, fmt.Errorf("trino query %s failed: %w", results.ID, results.Error)
+		}
+
+		for _, data := range results.Data {
+			row := make(QueryRow, len(data))
+			for i, value := range data {
+				row[i] = trinoValueToString(value)
+			}
+			rows = append(rows, row)
+		}
+
+		if results.NextURI == "" {
+			break
+		}
+
+		nextURI := results.NextURI
+		if ctx.Err() != nil {
+			e.cancel(nextURI)
+			return queryID, nil, fmt.Errorf("failed to fetch trino query results: %w", ctx.Err())
+		}
+
+		results, err = e.request(ctx, http.MethodGet, nextURI, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				e.cancel(nextURI)
+			}
+
+			return queryID, nil, fmt.Errorf("failed to fetch trino query results: %w", err)
+		}
+	}
+
+	return queryID, rows, nil
+}
+
+// cancel stops a query, which was abandoned by the client
+func (e *TrinoQueryEngine) cancel(nextURI string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, nextURI, nil)
+	if err != nil {
+		e.logger.Warn("failed to create trino cancel request", "error", err)
+		return
+	}
+	e.setHeaders(req)
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		e.logger.Warn("failed to cancel trino query", "error", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+func (e *TrinoQueryEngine) setHeaders(req *http.Request) {
+	req.Header.Set("X-Trino-User", e.cfg.User)
+	req.Header.Set("X-Trino-Source", TRINO_SOURCE)
+	if e.cfg.Catalog != "" {
+		req.Header.Set("X-Trino-Catalog", e.cfg.Catalog)
+	}
+	if e.cfg.Schema != "" {
+		req.Header.Set("X-Trino-Schema", e.cfg.Schema)
+	}
+	if e.cfg.Password != "" {
+		req.SetBasicAuth(e.cfg.User, e.cfg.Password)
+	}
+}
+
+func (e *TrinoQueryEngine) request(ctx context.Context, method string, url string, body []byte) (*trinoQueryResults, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		e.setHeaders(req)
+
+		resp, err := e.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute request: %w", err)
+		}
+
+		// The coordinator is busy and the request should be retried
+		if resp.StatusCode == http.StatusServiceUnavailable && attempt < TRINO_MAX_BUSY_RETRIES {
+			resp.Body.Close()
+
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(TRINO_BUSY_RETRY_PERIOD):
+			}
+			continue
+		}
+
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			return nil, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, respBody)
+		}
+
+		decoder := json.NewDecoder(resp.Body)
+		decoder.UseNumber()
+
+		var results trinoQueryResults
+		if err := decoder.Decode(&results); err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+
+		return &results, nil
+	}
+}
+
+func trinoValueToString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(encoded)
+	}
+}
+
+func (e *TrinoQueryEngine) Close() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
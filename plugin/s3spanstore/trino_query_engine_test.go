@@ -0,0 +1,352 @@
+package s3spanstore
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-lib/metrics"
+	"github.com/uber/jaeger-lib/metrics/metricstest"
+)
+
+// trinoStubServer implements the Trino statement protocol, returning every page on its own nextUri
+type trinoStubServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	queries   []string
+	headers   http.Header
+	pages     []map[string]interface{}
+	busy      int
+	cancelled bool
+}
+
+func NewTrinoStubServer(pages ...map[string]interface{}) *trinoStubServer {
+	s := &trinoStubServer{pages: pages}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *trinoStubServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.busy > 0 {
+		s.busy--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	page := 0
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/statement":
+		body, _ := io.ReadAll(r.Body)
+		s.queries = append(s.queries, string(body))
+		s.headers = r.Header.Clone()
+	case r.Method == http.MethodGet:
+		for i := range s.pages {
+			if r.URL.Path == s.pagePath(i) {
+				page = i
+			}
+		}
+	case r.Method == http.MethodDelete:
+		s.cancelled = true
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	response := map[string]interface{}{"id": "20230101_000000_00000_stub"}
+	if page < len(s.pages) {
+		for key, value := range s.pages[page] {
+			response[key] = value
+		}
+	}
+	if page+1 < len(s.pages) {
+		response["nextUri"] = s.URL + s.pagePath(page+1)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func (s *trinoStubServer) pagePath(page int) string {
+	return "/v1/statement/executing/stub/" + string(rune('0'+page))
+}
+
+func NewTestTrinoQueryEngine(endpoint string, metricsFactory metrics.Factory) *TrinoQueryEngine {
+	loggerName := "jaeger-s3"
+
+	logLevel := os.Getenv("GRPC_STORAGE_PLUGIN_LOG_LEVEL")
+	if logLevel == "" {
+		logLevel = hclog.Debug.String()
+	}
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Level:      hclog.LevelFromString(logLevel),
+		Name:       loggerName,
+		JSONFormat: true,
+	})
+
+	return NewTrinoQueryEngine(logger, metricsFactory, &http.Client{}, config.Trino{
+		Endpoint: endpoint,
+		User:     "jaeger",
+		Catalog:  "hive",
+		Schema:   "jaeger",
+	})
+}
+
+func TestTrinoQuery(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	server := NewTrinoStubServer(
+		map[string]interface{}{"stats": map[string]interface{}{"state": "QUEUED"}},
+		map[string]interface{}{
+			"columns": []interface{}{map[string]interface{}{"name": "service_name"}, map[string]interface{}{"name": "count"}},
+			"data":    []interface{}{[]interface{}{"service-a", 1}},
+		},
+		map[string]interface{}{
+			"data": []interface{}{[]interface{}{"service-b", nil}, []interface{}{true, map[string]interface{}{"k": "v"}}},
+		},
+	)
+	defer server.Close()
+	server.busy = 1
+
+	engine := NewTestTrinoQueryEngine(server.URL, metrics.NullFactory)
+	defer engine.Close()
+
+	rows, err := engine.Query(ctx, QueryKindGetServices, "SELECT 1")
+	assert.NoError(err)
+	assert.Equal([]QueryRow{{"service-a", "1"}, {"service-b", ""}, {"true", `{"k":"v"}`}}, rows)
+
+	assert.Equal([]string{"SELECT 1"}, server.queries)
+	assert.Equal("jaeger", server.headers.Get("X-Trino-User"))
+	assert.Equal("hive", server.headers.Get("X-Trino-Catalog"))
+	assert.Equal("jaeger", server.headers.Get("X-Trino-Schema"))
+	assert.Equal(TRINO_SOURCE, server.headers.Get("X-Trino-Source"))
+}
+
+func TestTrinoQueryError(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	server := NewTrinoStubServer(
+		map[string]interface{}{"stats": map[string]interface{}{"state": "QUEUED"}},
+		map[string]interface{}{"error": map[string]interface{}{
+			"message":   "line 1:15: Table 'hive.jaeger.jaeger_spans' does not exist",
+			"errorCode": 46,
+			"errorName": "TABLE_NOT_FOUND",
+			"errorType": "USER_ERROR",
+		}},
+	)
+	defer server.Close()
+
+	engine := NewTestTrinoQueryEngine(server.URL, metrics.NullFactory)
+	defer engine.Close()
+
+	_, err := engine.Query(ctx, QueryKindGetTrace, "SELECT * FROM jaeger_spans")
+	assert.ErrorContains(err, "TABLE_NOT_FOUND")
+}
+
+func TestTrinoQueryCancelled(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	server := NewTrinoStubServer(
+		map[string]interface{}{"stats": map[string]interface{}{"state": "QUEUED"}},
+		map[string]interface{}{"stats": map[string]interface{}{"state": "RUNNING"}},
+		map[string]interface{}{"data": []interface{}{}},
+	)
+	defer server.Close()
+
+	engine := NewTestTrinoQueryEngine(server.URL, metrics.NullFactory)
+	engine.client.Transport = &cancellingTransport{cancel: cancel, after: 1}
+	defer engine.Close()
+
+	_, err := engine.Query(ctx, QueryKindGetServices, "SELECT 1")
+	assert.ErrorIs(err, context.Canceled)
+	assert.True(server.cancelled)
+}
+
+// cancellingTransport cancels the query context after the given number of requests
+type cancellingTransport struct {
+	cancel   context.CancelFunc
+	after    int
+	requests int
+}
+
+func (t *cancellingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodDelete {
+		t.requests++
+		if t.requests > t.after {
+			t.cancel()
+			return nil, req.Context().Err()
+		}
+	}
+
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestTrinoQueryMetrics(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	server := NewTrinoStubServer(
+		map[string]interface{}{"data": []interface{}{[]interface{}{"service-a"}}},
+	)
+	defer server.Close()
+
+	metricsFactory := metricstest.NewFactory(0)
+	defer metricsFactory.Stop()
+
+	engine := NewTestTrinoQueryEngine(server.URL, metricsFactory)
+	defer engine.Close()
+
+	_, err := engine.Query(ctx, QueryKindGetServices, "SELECT service_name FROM jaeger_operations")
+	assert.NoError(err)
+
+	server.pages = []map[string]interface{}{
+		{"error": map[string]interface{}{"errorName": "TABLE_NOT_FOUND", "errorType": "USER_ERROR"}},
+	}
+	_, err = engine.Query(ctx, QueryKindGetTrace, "SELECT * FROM jaeger_spans")
+	assert.ErrorContains(err, "TABLE_NOT_FOUND")
+
+	metricsFactory.AssertCounterMetrics(t,
+		metricstest.ExpectedMetric{Name: "trino_queries", Tags: map[string]string{"query_kind": "GetServices"}, Value: 1},
+		metricstest.ExpectedMetric{Name: "trino_query_errors", Tags: map[string]string{"query_kind": "GetServices"}, Value: 0},
+		metricstest.ExpectedMetric{Name: "trino_queries", Tags: map[string]string{"query_kind": "GetTrace"}, Value: 1},
+		metricstest.ExpectedMetric{Name: "trino_query_errors", Tags: map[string]string{"query_kind": "GetTrace"}, Value: 1},
+	)
+
+	_, timers := metricsFactory.Snapshot()
+	assert.Contains(timers, "trino_query_duration|query_kind=GetServices.P50")
+	assert.Contains(timers, "trino_query_duration|query_kind=GetTrace.P50")
+}
+
+func TestTrinoQueryCancelledAfterStart(t *testing.T) {
+	tests := []struct {
+		name          string
+		request       int
+		afterResponse bool
+	}{
+		{name: "while starting", request: 1},
+		{name: "after starting", request: 1, afterResponse: true},
+		{name: "between polls", request: 2, afterResponse: true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			server := NewTrinoStubServer(
+				map[string]interface{}{"stats": map[string]interface{}{"state": "QUEUED"}},
+				map[string]interface{}{"stats": map[string]interface{}{"state": "RUNNING"}},
+				map[string]interface{}{"data": []interface{}{}},
+			)
+			defer server.Close()
+
+			engine := NewTestTrinoQueryEngine(server.URL, metrics.NullFactory)
+			engine.client.Transport = &cancellingOnRequestTransport{cancel: cancel, request: tt.request, afterResponse: tt.afterResponse}
+			defer engine.Close()
+
+			_, err := engine.Query(ctx, QueryKindGetServices, "SELECT 1")
+			assert.ErrorIs(err, context.Canceled)
+			assert.True(server.cancelled)
+		})
+	}
+}
+
+// cancellingOnRequestTransport cancels the query context while or after executing the given request,
+// without failing the request
+type cancellingOnRequestTransport struct {
+	cancel        context.CancelFunc
+	request       int
+	afterResponse bool
+	requests      int
+}
+
+func (t *cancellingOnRequestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodDelete {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+
+	t.requests++
+	if t.requests != t.request {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+
+	if !t.afterResponse {
+		t.cancel()
+	}
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if t.afterResponse {
+		t.cancel()
+	}
+
+	return resp, err
+}
+
+func TestTrinoReader(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	server := NewTrinoStubServer(
+		map[string]interface{}{"data": []interface{}{[]interface{}{"service-a"}, []interface{}{"service-b"}}},
+	)
+	defer server.Close()
+
+	engine := NewTestTrinoQueryEngine(server.URL, metrics.NullFactory)
+	defer engine.Close()
+
+	reader, err := NewReaderWithQueryEngine(ctx, hclog.NewNullLogger(), engine, config.Athena{
+		SpansTableName:      "jaeger_spans",
+		OperationsTableName: "jaeger_operations",
+		MaxSpanAge:          "336h",
+	}, PartitionScheme{}, nil)
+	assert.NoError(err)
+	defer reader.Close()
+
+	services, err := reader.GetServices(ctx)
+	assert.NoError(err)
+	assert.Equal([]string{"service-a", "service-b"}, services)
+
+	server.pages = []map[string]interface{}{
+		{"data": []interface{}{[]interface{}{"0000000000000001000000000000000a"}}},
+	}
+
+	traceIDs, err := reader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+		ServiceName: "service-a",
+		Tags:        map[string]string{"http.status_code": "500"},
+		NumTraces:   20,
+	})
+	assert.NoError(err)
+	assert.Equal([]model.TraceID{model.NewTraceID(1, 10)}, traceIDs)
+	assert.Contains(server.queries[len(server.queries)-1], `element_at(tags, 'http.status_code') = '500'`)
+}
+
+func TestTrinoDecodeBinary(t *testing.T) {
+	assert := assert.New(t)
+
+	engine := NewTestTrinoQueryEngine("http://localhost:8080", metrics.NullFactory)
+
+	value, err := engine.DecodeBinary("AP8Kc25hcHB5")
+	assert.NoError(err)
+	assert.Equal([]byte("\x00\xff\nsnappy"), value)
+}
@@ -0,0 +1,215 @@
+package s3spanstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/uber/jaeger-lib/metrics"
+)
+
+// WriteBufferPolicy controls how spans are handled, once the write buffer memory budget is exhausted
+type WriteBufferPolicy string
+
+const (
+	// WriteBufferPolicyBlock waits until buffered spans have been uploaded
+	WriteBufferPolicyBlock WriteBufferPolicy = "block"
+	// WriteBufferPolicyDropOldest drops the oldest queued spans, which haven't been written into a parquet
+	// file yet. Spans written into parquet files can't be dropped, so once they exhaust the budget on
+	// their own new spans wait until they have been uploaded.
+	WriteBufferPolicyDropOldest WriteBufferPolicy = "drop_oldest"
+	// WriteBufferPolicyError rejects the span, so the Jaeger collector queue retries it. Spans failing
+	// to be written after they were buffered aren't retried.
+	WriteBufferPolicyError WriteBufferPolicy = "error"
+)
+
+var (
+	ErrWriteBufferFull   = errors.New("write buffer full")
+	ErrWriteBufferClosed = errors.New("write buffer closed")
+)
+
+type writeBufferItem struct {
+	span       *model.Span
+	spanRecord *SpanRecord
+	size       int64
+}
+
+// WriteBuffer queues spans in front of the parquet writers and bounds the memory used by queued
+// spans and spans written into parquet files, which haven't been uploaded yet.
+type WriteBuffer struct {
+	logger   hclog.Logger
+	metrics  *WriteBufferMetrics
+	maxBytes int64
+	policy   WriteBufferPolicy
+
+	mutex sync.Mutex
+	items []*writeBufferItem
+	// bytes contains the size of queued items and items popped, but not released yet
+	bytes int64
+	// changed is closed and replaced whenever bytes got released, items got pushed or the buffer got closed
+	changed chan struct{}
+	closed  bool
+	// Number of spans dropped or rejected since the buffer got full
+	discarded int64
+}
+
+func NewWriteBuffer(logger hclog.Logger, metricsFactory metrics.Factory, maxBytes int64, policy WriteBufferPolicy) (*WriteBuffer, error) {
+	switch policy {
+	case "":
+		policy = WriteBufferPolicyBlock
+	case WriteBufferPolicyBlock, WriteBufferPolicyDropOldest, WriteBufferPolicyError:
+	default:
+		return nil, fmt.Errorf("unknown write buffer policy %q", policy)
+	}
+
+	return &WriteBuffer{
+		logger:   logger,
+		metrics:  newWriteBufferMetrics(metricsFactory),
+		maxBytes: maxBytes,
+		policy:   policy,
+		changed:  make(chan struct{}),
+	}, nil
+}
+
+// Push queues an item, applying the buffer policy if the memory budget is exhausted. An item
+// is always accepted into an empty buffer, so spans larger than the budget can't block forever.
+func (b *WriteBuffer) Push(ctx context.Context, item *writeBufferItem) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for {
+		if b.closed {
+			return ErrWriteBufferClosed
+		}
+
+		if b.bytes == 0 || b.bytes+item.size <= b.maxBytes {
+			break
+		}
+
+		switch b.policy {
+		case WriteBufferPolicyError:
+			b.metrics.SpansRejected.Inc(1)
+			b.discardedLocked()
+			return ErrWriteBufferFull
+		case WriteBufferPolicyDropOldest:
+			// All buffered spans are already written into parquet files, wait until they got uploaded
+			if len(b.items) == 0 {
+				if err := b.waitLocked(ctx); err != nil {
+					return err
+				}
+				continue
+			}
+
+			b.metrics.SpansDropped.Inc(1)
+			b.discardedLocked()
+
+			oldest := b.items[0]
+			b.items[0] = nil
+			b.items = b.items[1:]
+			b.bytes -= oldest.size
+		default:
+			if err := b.waitLocked(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	if b.discarded > 0 {
+		b.logger.Info("write buffer recovered", "policy", b.policy, "discardedSpans", b.discarded)
+		b.discarded = 0
+	}
+
+	b.items = append(b.items, item)
+	b.bytes += item.size
+	b.changedLocked()
+
+	return nil
+}
+
+// waitLocked waits until bytes got released, items got pushed or the buffer got closed
+func (b *WriteBuffer) waitLocked(ctx context.Context) error {
+	changed := b.changed
+	b.mutex.Unlock()
+
+	select {
+	case <-changed:
+		b.mutex.Lock()
+		return nil
+	case <-ctx.Done():
+		b.mutex.Lock()
+		return fmt.Errorf("failed to wait for write buffer: %w", ctx.Err())
+	}
+}
+
+// Pop blocks until an item is available. The item size stays accounted for until it is released.
+// Returns false once the buffer is closed and all items have been popped.
+func (b *WriteBuffer) Pop() (*writeBufferItem, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for len(b.items) == 0 {
+		if b.closed {
+			return nil, false
+		}
+
+		changed := b.changed
+		b.mutex.Unlock()
+		<-changed
+		b.mutex.Lock()
+	}
+
+	item := b.items[0]
+	b.items[0] = nil
+	b.items = b.items[1:]
+
+	return item, true
+}
+
+// Len returns the number of queued items
+func (b *WriteBuffer) Len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return len(b.items)
+}
+
+// Release returns bytes of popped items to the memory budget
+func (b *WriteBuffer) Release(bytes int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.bytes -= bytes
+	b.changedLocked()
+}
+
+// Failed counts a popped item, which failed to be written. The span was already accepted, so
+// the Jaeger collector won't retry it.
+func (b *WriteBuffer) Failed() {
+	b.metrics.SpansFailed.Inc(1)
+}
+
+// Close stops accepting new items, already queued items can still be popped
+func (b *WriteBuffer) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.closed = true
+	b.changedLocked()
+}
+
+func (b *WriteBuffer) changedLocked() {
+	b.metrics.BufferedBytes.Update(b.bytes)
+
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *WriteBuffer) discardedLocked() {
+	if b.discarded == 0 {
+		b.logger.Warn("write buffer full, discarding spans", "policy", b.policy, "maxBytes", b.maxBytes)
+	}
+	b.discarded++
+}
@@ -0,0 +1,311 @@
+package s3spanstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-lib/metrics"
+	"github.com/uber/jaeger-lib/metrics/metricstest"
+)
+
+func NewTestWriteBuffer(assert *assert.Assertions, metricsFactory metrics.Factory, maxBytes int64, policy WriteBufferPolicy) *WriteBuffer {
+	logger := hclog.New(&hclog.LoggerOptions{
+		Level:      hclog.Debug,
+		Name:       "jaeger-s3",
+		JSONFormat: true,
+	})
+
+	buffer, err := NewWriteBuffer(logger, metricsFactory, maxBytes, policy)
+	assert.NoError(err)
+
+	return buffer
+}
+
+func TestWriteBufferBlock(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	buffer := NewTestWriteBuffer(assert, metrics.NullFactory, 100, WriteBufferPolicyBlock)
+
+	assert.NoError(buffer.Push(ctx, &writeBufferItem{size: 60}))
+
+	// The budget is exhausted until the first item is released
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(buffer.Push(timeoutCtx, &writeBufferItem{size: 60}), context.DeadlineExceeded)
+
+	pushed := make(chan error)
+	go func() {
+		pushed <- buffer.Push(ctx, &writeBufferItem{size: 60})
+	}()
+
+	item, ok := buffer.Pop()
+	assert.True(ok)
+
+	select {
+	case <-pushed:
+		assert.Fail("push didn't block until the item got released")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	buffer.Release(item.size)
+	assert.NoError(<-pushed)
+}
+
+func TestWriteBufferDropOldest(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	metricsFactory := metricstest.NewFactory(0)
+	buffer := NewTestWriteBuffer(assert, metricsFactory, 100, WriteBufferPolicyDropOldest)
+
+	first := &writeBufferItem{size: 40}
+	second := &writeBufferItem{size: 40}
+	third := &writeBufferItem{size: 40}
+
+	assert.NoError(buffer.Push(ctx, first))
+	assert.NoError(buffer.Push(ctx, second))
+	assert.NoError(buffer.Push(ctx, third))
+
+	item, ok := buffer.Pop()
+	assert.True(ok)
+	assert.Same(second, item)
+
+	metricsFactory.AssertCounterMetrics(t, metricstest.ExpectedMetric{Name: "write_buffer_spans_dropped", Value: 1})
+	metricsFactory.AssertGaugeMetrics(t, metricstest.ExpectedMetric{Name: "write_buffer_bytes", Value: 80})
+}
+
+func TestWriteBufferDropOldestWithoutQueuedItems(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	metricsFactory := metricstest.NewFactory(0)
+	buffer := NewTestWriteBuffer(assert, metricsFactory, 100, WriteBufferPolicyDropOldest)
+
+	assert.NoError(buffer.Push(ctx, &writeBufferItem{size: 60}))
+	item, ok := buffer.Pop()
+	assert.True(ok)
+
+	// The popped item can't be dropped, so the new item waits until it got released
+	pushed := make(chan error)
+	go func() {
+		pushed <- buffer.Push(ctx, &writeBufferItem{size: 60})
+	}()
+
+	select {
+	case <-pushed:
+		assert.Fail("push didn't block until the item got released")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	buffer.Release(item.size)
+	assert.NoError(<-pushed)
+	assert.Equal(1, buffer.Len())
+
+	metricsFactory.AssertCounterMetrics(t)
+}
+
+func TestWriteBufferDropOldestSlowConsumer(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	metricsFactory := metricstest.NewFactory(0)
+	buffer := NewTestWriteBuffer(assert, metricsFactory, 100, WriteBufferPolicyDropOldest)
+
+	// The consumer starts late and items are only released once their file got uploaded
+	start := make(chan struct{})
+	consumed := make(chan []uint64)
+	go func() {
+		<-start
+
+		var spanIDs []uint64
+		for {
+			item, ok := buffer.Pop()
+			if !ok {
+				consumed <- spanIDs
+				return
+			}
+
+			spanIDs = append(spanIDs, uint64(item.span.SpanID))
+			time.AfterFunc(10*time.Millisecond, func() {
+				buffer.Release(item.size)
+			})
+		}
+	}()
+
+	push := func(from int, to int) {
+		for i := from; i < to; i++ {
+			assert.NoError(buffer.Push(ctx, &writeBufferItem{
+				span: &model.Span{SpanID: model.NewSpanID(uint64(i))},
+				size: 10,
+			}))
+		}
+	}
+
+	// The budget fits 10 items, so the 10 oldest queued items are dropped
+	push(0, 20)
+	close(start)
+	assert.Eventually(func() bool {
+		return buffer.Len() == 0
+	}, time.Second, time.Millisecond)
+
+	// Written items exhausting the budget can't be dropped, so new items wait until they got released
+	push(20, 50)
+	buffer.Close()
+	spanIDs := <-consumed
+
+	expected := make([]uint64, 0, 10)
+	for i := 10; i < 20; i++ {
+		expected = append(expected, uint64(i))
+	}
+	assert.Equal(expected, spanIDs[:10])
+	assert.IsIncreasing(spanIDs)
+	assert.Equal(uint64(49), spanIDs[len(spanIDs)-1])
+
+	dropped, _ := metricsFactory.Snapshot()
+	assert.Equal(int64(50-len(spanIDs)), dropped["write_buffer_spans_dropped"])
+}
+
+func TestWriteBufferError(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	metricsFactory := metricstest.NewFactory(0)
+	buffer := NewTestWriteBuffer(assert, metricsFactory, 100, WriteBufferPolicyError)
+
+	assert.NoError(buffer.Push(ctx, &writeBufferItem{size: 60}))
+	assert.ErrorIs(buffer.Push(ctx, &writeBufferItem{size: 60}), ErrWriteBufferFull)
+
+	// Spans larger than the budget are accepted into an empty buffer
+	item, ok := buffer.Pop()
+	assert.True(ok)
+	buffer.Release(item.size)
+	assert.NoError(buffer.Push(ctx, &writeBufferItem{size: 200}))
+
+	metricsFactory.AssertCounterMetrics(t, metricstest.ExpectedMetric{Name: "write_buffer_spans_rejected", Value: 1})
+}
+
+func TestWriteBufferClosed(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	buffer := NewTestWriteBuffer(assert, metrics.NullFactory, 100, WriteBufferPolicyBlock)
+
+	assert.NoError(buffer.Push(ctx, &writeBufferItem{size: 60}))
+	buffer.Close()
+	assert.ErrorIs(buffer.Push(ctx, &writeBufferItem{size: 10}), ErrWriteBufferClosed)
+
+	// Queued items are still available after closing
+	_, ok := buffer.Pop()
+	assert.True(ok)
+	_, ok = buffer.Pop()
+	assert.False(ok)
+}
+
+func TestNewWriteBufferUnknownPolicy(t *testing.T) {
+	_, err := NewWriteBuffer(hclog.NewNullLogger(), metrics.NullFactory, 100, "unknown")
+	assert.Error(t, err)
+}
+
+func TestWriteSpanWithWriteBuffer(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockSvc := mocks.NewMockS3API(ctrl)
+
+	putTest := NewS3PutTest()
+	defer putTest.Clean()
+
+	mockSvc.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		localTestObjects(putTest, assert)).Times(2)
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Level:      hclog.Debug,
+		Name:       "jaeger-s3",
+		JSONFormat: true,
+	})
+
+	metricsFactory := metricstest.NewFactory(0)
+	writer, err := NewWriter(ctx, logger, metricsFactory, mockSvc, config.S3{
+		BucketName:       "jaeger-spans",
+		SpansPrefix:      "/spans/",
+		OperationsPrefix: "/operations/",
+		MaxBufferedBytes: 1 << 20,
+	}, PartitionScheme{})
+	assert.NoError(err)
+
+	span := NewTestSpan(assert)
+	assert.NoError(writer.WriteSpan(ctx, span))
+
+	// Buffered spans are written on close and their memory released once uploaded
+	assert.NoError(writer.Close())
+	assert.NotEmpty(putTest.SpansFile())
+
+	metricsFactory.AssertCounterMetrics(t, metricstest.ExpectedMetric{Name: "spans_written", Value: 1})
+	metricsFactory.AssertGaugeMetrics(t, metricstest.ExpectedMetric{Name: "write_buffer_bytes", Value: 0})
+}
+
+func TestWriteSpanWithWriteBufferFailure(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	// Files can't be created below a regular file
+	directory := filepath.Join(t.TempDir(), "file")
+	assert.NoError(os.WriteFile(directory, []byte{}, 0644))
+
+	metricsFactory := metricstest.NewFactory(0)
+	writer, err := NewWriter(ctx, hclog.NewNullLogger(), metricsFactory, nil, config.S3{
+		SpansPrefix:      "spans/",
+		OperationsPrefix: "operations/",
+		LocalDirectory:   directory,
+		MaxBufferedBytes: 1 << 20,
+	}, PartitionScheme{})
+	assert.NoError(err)
+
+	// The span is accepted once buffered, the failure is only counted
+	assert.NoError(writer.WriteSpan(ctx, NewTestSpan(assert)))
+	writer.Close()
+
+	metricsFactory.AssertCounterMetrics(t,
+		metricstest.ExpectedMetric{Name: "write_buffer_spans_failed", Value: 1},
+		metricstest.ExpectedMetric{Name: "spans_failed", Value: 1},
+	)
+	metricsFactory.AssertGaugeMetrics(t, metricstest.ExpectedMetric{Name: "write_buffer_bytes", Value: 0})
+}
+
+func TestWriteSpanWithWriteBufferSortSpans(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	metricsFactory := metricstest.NewFactory(0)
+	writer, err := NewWriter(ctx, hclog.NewNullLogger(), metricsFactory, nil, config.S3{
+		SpansPrefix:      "spans/",
+		OperationsPrefix: "operations/",
+		LocalDirectory:   t.TempDir(),
+		MaxBufferedBytes: 1 << 20,
+		SortSpans:        true,
+	}, PartitionScheme{})
+	assert.NoError(err)
+
+	assert.NoError(writer.WriteSpan(ctx, NewTestSpan(assert)))
+	assert.Eventually(func() bool { return writer.buffer.Len() == 0 }, time.Second, time.Millisecond)
+
+	// Sorted spans are kept in memory until their file is closed and stay accounted for
+	_, gauges := metricsFactory.Snapshot()
+	assert.Greater(gauges["write_buffer_bytes"], int64(0))
+
+	assert.NoError(writer.Close())
+	metricsFactory.AssertGaugeMetrics(t, metricstest.ExpectedMetric{Name: "write_buffer_bytes", Value: 0})
+}
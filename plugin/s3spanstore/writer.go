@@ -3,14 +3,17 @@ package s3spanstore
 import (
 	"context"
 	"fmt"
-	"math/rand"
+	"runtime"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/hashicorp/go-hclog"
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/jaegertracing/jaeger/model"
 	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/uber/jaeger-lib/metrics"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -29,10 +32,22 @@ type S3API interface {
 }
 
 type Writer struct {
-	logger hclog.Logger
+	ctx     context.Context
+	logger  hclog.Logger
+	metrics *WriterMetrics
 
+	sink                    ParquetFileSink
 	spanParquetWriter       IParquetWriter
 	operationsParquetWriter *DedupeParquetWriter
+	tagFilter               *TagFilter
+	partitions              PartitionScheme
+	// unlistedServices contains the services already warned about, which are written into
+	// OtherServicePartition as they aren't listed in the partitioning service names
+	unlistedServices *lru.Cache
+
+	// buffer is only set, when the memory used for buffering spans is bounded
+	buffer         *WriteBuffer
+	bufferConsumer sync.WaitGroup
 }
 
 func EmptyBucket(ctx context.Context, svc S3API, bucketName string) error {
@@ -66,12 +81,45 @@ var (
 	defaultOperationsDedupeRewriteBufferDuration = time.Hour * 1
 )
 
-func NewWriter(ctx context.Context, logger hclog.Logger, svc S3API, s3Config config.S3) (*Writer, error) {
-	rand.Seed(time.Now().UnixNano())
+// unlistedServicesCacheSize bounds the number of services remembered as already warned about
+const unlistedServicesCacheSize = 1000
 
+func NewParquetWriterOptions(s3Config config.S3) (ParquetWriterOptions, error) {
 	bufferDuration, err := parseDurationWithDefault(s3Config.BufferDuration, defaultBufferDuration)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse buffer duration: %w", err)
+		return ParquetWriterOptions{}, fmt.Errorf("failed to parse buffer duration: %w", err)
+	}
+
+	instanceID := DefaultInstanceID()
+	if s3Config.InstanceID != "" {
+		instanceID = SanitizeInstanceID(s3Config.InstanceID)
+	}
+
+	return ParquetWriterOptions{
+		InstanceID:     instanceID,
+		BufferDuration: bufferDuration,
+		MaxFileRows:    s3Config.MaxFileRows,
+		MaxFileBytes:   s3Config.MaxFileBytes,
+
+		MaxConcurrentFlushes: s3Config.MaxConcurrentFlushes,
+
+		CompressionCodec: s3Config.CompressionCodec,
+		RowGroupSize:     s3Config.RowGroupSize,
+		PageSize:         s3Config.PageSize,
+		Concurrency:      s3Config.WriterConcurrency,
+	}, nil
+}
+
+func NewWriter(ctx context.Context, logger hclog.Logger, metricsFactory metrics.Factory, svc S3API, s3Config config.S3, partitions PartitionScheme) (*Writer, error) {
+	parquetWriterOpts, err := NewParquetWriterOptions(s3Config)
+	if err != nil {
+		return nil, err
+	}
+	parquetWriterOpts.Partitions = partitions
+
+	spanRecordSchema, err := newSpanRecordSchema(s3Config.PromotedTags)
+	if err != nil {
+		return nil, err
 	}
 
 	operationsDedupeDuration, err := parseDurationWithDefault(s3Config.OperationsDedupeDuration, defaultOperationsDedupeDuration)
@@ -89,18 +137,46 @@ func NewWriter(ctx context.Context, logger hclog.Logger, svc S3API, s3Config con
 		return nil, fmt.Errorf("failed to parse operation dedupe rewrite buffer duration: %w", err)
 	}
 
+	sink, err := NewParquetFileSink(logger, metricsFactory, svc, s3Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create parquet file sink: %w", err)
+	}
+
 	if s3Config.EmptyBucket {
-		if err := EmptyBucket(ctx, svc, s3Config.BucketName); err != nil {
+		if err := sink.Empty(ctx); err != nil {
 			return nil, fmt.Errorf("failed to empty s3 bucket: %w", err)
 		}
 	}
 
-	spanParquetWriter, err := NewParquetWriter(ctx, logger, svc, bufferDuration, s3Config.BucketName, s3Config.SpansPrefix, new(SpanRecord))
+	if spillSink, ok := sink.(*SpillParquetFileSink); ok {
+		if err := spillSink.Replay(); err != nil {
+			return nil, fmt.Errorf("failed to replay spilled parquet files: %w", err)
+		}
+	}
+
+	var buffer *WriteBuffer
+	spanParquetWriterOpts := parquetWriterOpts
+	spanParquetWriterOpts.SortRows = s3Config.SortSpans
+	if s3Config.MaxBufferedBytes > 0 {
+		buffer, err = NewWriteBuffer(logger, metricsFactory, s3Config.MaxBufferedBytes, WriteBufferPolicy(s3Config.BufferFullPolicy))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create write buffer: %w", err)
+		}
+
+		spanParquetWriterOpts.OnFileClosed = buffer.Release
+
+		// Upload files before they exhaust the memory budget on their own
+		if maxFileBytes := s3Config.MaxBufferedBytes / 2; spanParquetWriterOpts.MaxFileBytes == 0 || spanParquetWriterOpts.MaxFileBytes > maxFileBytes {
+			spanParquetWriterOpts.MaxFileBytes = maxFileBytes
+		}
+	}
+
+	spanParquetWriter, err := NewParquetWriter(ctx, logger, parquetWriterMetricsFactory(metricsFactory, "spans"), sink, s3Config.SpansPrefix, spanRecordSchema, spanParquetWriterOpts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create parquet writer: %w", err)
 	}
 
-	operationsParquetWriter, err := NewParquetWriter(ctx, logger, svc, bufferDuration, s3Config.BucketName, s3Config.OperationsPrefix, new(OperationRecord))
+	operationsParquetWriter, err := NewParquetWriter(ctx, logger, parquetWriterMetricsFactory(metricsFactory, "operations"), sink, s3Config.OperationsPrefix, new(OperationRecord), parquetWriterOpts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create parquet writer: %w", err)
 	}
@@ -110,10 +186,30 @@ func NewWriter(ctx context.Context, logger hclog.Logger, svc S3API, s3Config con
 		return nil, fmt.Errorf("failed to create parquet writer: %w", err)
 	}
 
+	unlistedServices, err := lru.New(unlistedServicesCacheSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create unlisted services cache: %w", err)
+	}
+
 	w := &Writer{
+		ctx:                     ctx,
 		logger:                  logger,
+		metrics:                 newWriterMetrics(metricsFactory),
+		sink:                    sink,
 		operationsParquetWriter: operationsDedupeParquetWriter,
 		spanParquetWriter:       spanParquetWriter,
+		tagFilter:               NewTagFilter(s3Config),
+		partitions:              partitions,
+		unlistedServices:        unlistedServices,
+		buffer:                  buffer,
+	}
+
+	if buffer != nil {
+		// Multiple consumers keep writing spans and operations concurrently like unbuffered writes
+		for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+			w.bufferConsumer.Add(1)
+			go w.consumeBuffer()
+		}
 	}
 
 	return w, nil
@@ -122,6 +218,58 @@ func NewWriter(ctx context.Context, logger hclog.Logger, svc S3API, s3Config con
 func (w *Writer) WriteSpan(ctx context.Context, span *model.Span) error {
 	// s.logger.Debug("WriteSpan", span)
 
+	spanRecord, err := NewSpanRecordFromSpan(span, w.tagFilter)
+	if err != nil {
+		w.metrics.SpansFailed.Inc(1)
+		return fmt.Errorf("failed to create span record: %w", err)
+	}
+
+	w.checkServicePartition(span.Process.ServiceName)
+
+	if w.buffer != nil {
+		return w.buffer.Push(ctx, &writeBufferItem{
+			span:       span,
+			spanRecord: spanRecord,
+			size:       approximateRowSize(spanRecord),
+		})
+	}
+
+	return w.writeSpan(ctx, span, spanRecord)
+}
+
+// checkServicePartition counts spans of services, which aren't listed in the partitioning service
+// names and warns once per service, as their spans are written into OtherServicePartition.
+func (w *Writer) checkServicePartition(serviceName string) {
+	if !w.partitions.ServiceNamePartitioned() || w.partitions.ServiceListed(serviceName) {
+		return
+	}
+
+	w.metrics.SpansUnlistedService.Inc(1)
+	if found, _ := w.unlistedServices.ContainsOrAdd(serviceName, struct{}{}); !found {
+		w.logger.Warn("service isn't listed in partitioning.serviceNames, writing its spans into the shared service partition",
+			"service", serviceName, "partition", OtherServicePartition)
+	}
+}
+
+// consumeBuffer writes buffered spans into the parquet writers until the buffer is closed. Spans
+// are acknowledged once buffered, so failures are only logged and counted.
+func (w *Writer) consumeBuffer() {
+	defer w.bufferConsumer.Done()
+
+	for {
+		item, ok := w.buffer.Pop()
+		if !ok {
+			return
+		}
+
+		if err := w.writeSpan(w.ctx, item.span, item.spanRecord); err != nil {
+			w.buffer.Failed()
+			w.logger.Error("failed to write buffered span", "error", err)
+		}
+	}
+}
+
+func (w *Writer) writeSpan(ctx context.Context, span *model.Span, spanRecord *SpanRecord) error {
 	g, gCtx := errgroup.WithContext(ctx)
 
 	g.Go(func() error {
@@ -138,22 +286,44 @@ func (w *Writer) WriteSpan(ctx context.Context, span *model.Span) error {
 	})
 
 	g.Go(func() error {
-		spanRecord, err := NewSpanRecordFromSpan(span)
-		if err != nil {
-			return fmt.Errorf("failed to create span record: %w", err)
-		}
-
 		if err := w.spanParquetWriter.Write(gCtx, span.StartTime, span.StartTime, spanRecord); err != nil {
+			// The span never made it into a parquet file, which would release it once closed
+			if w.buffer != nil {
+				w.buffer.Release(approximateRowSize(spanRecord))
+			}
+
 			return fmt.Errorf("failed to write span item: %w", err)
 		}
 
 		return nil
 	})
 
-	return g.Wait()
+	if err := g.Wait(); err != nil {
+		w.metrics.SpansFailed.Inc(1)
+		return err
+	}
+	w.metrics.SpansWritten.Inc(1)
+
+	return nil
+}
+
+// FlushStats counts spans written into parquet files and spans still queued in the write buffer
+func (w *Writer) FlushStats() FlushStats {
+	stats := w.spanParquetWriter.FlushStats()
+	if w.buffer != nil {
+		stats.RowsWritten += int64(w.buffer.Len())
+	}
+
+	return stats
 }
 
 func (w *Writer) Close() error {
+	// Write all buffered spans, before closing the parquet writers
+	if w.buffer != nil {
+		w.buffer.Close()
+		w.bufferConsumer.Wait()
+	}
+
 	g := errgroup.Group{}
 
 	g.Go(func() error {
@@ -172,5 +342,13 @@ func (w *Writer) Close() error {
 		return nil
 	})
 
-	return g.Wait()
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	if err := w.sink.Close(); err != nil {
+		return fmt.Errorf("failed to close parquet file sink: %w", err)
+	}
+
+	return nil
 }
@@ -4,10 +4,12 @@ import (
 	"context"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gogo/protobuf/jsonpb"
 	"github.com/golang/mock/gomock"
@@ -16,6 +18,8 @@ import (
 	"github.com/johanneswuerbach/jaeger-s3/plugin/config"
 	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore/mocks"
 	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-lib/metrics"
+	"github.com/uber/jaeger-lib/metrics/metricstest"
 	"github.com/xitongsys/parquet-go-source/local"
 	"github.com/xitongsys/parquet-go/reader"
 )
@@ -34,11 +38,11 @@ func NewTestWriter(ctx context.Context, assert *assert.Assertions, mockSvc *mock
 		JSONFormat: true,
 	})
 
-	writer, err := NewWriter(ctx, logger, mockSvc, config.S3{
+	writer, err := NewWriter(ctx, logger, metrics.NullFactory, mockSvc, config.S3{
 		BucketName:       "jaeger-spans",
 		SpansPrefix:      "/spans/",
 		OperationsPrefix: "/operations/",
-	})
+	}, PartitionScheme{})
 
 	assert.NoError(err)
 
@@ -131,11 +135,23 @@ func TestS3ParquetKey(t *testing.T) {
 
 	testTime1 := time.Date(2021, 1, 30, 6, 34, 58, 123, time.UTC)
 
-	assert.Equal("prefix/2021/01/30/06/random.parquet", S3ParquetKey("prefix/", "random", S3PartitionKey(testTime1)))
+	assert.Equal("prefix/2021/01/30/06/random.parquet", S3ParquetKey("prefix/", "random", PartitionScheme{}.Key(testTime1)))
 
 	testTime2 := time.Date(2021, 1, 30, 18, 34, 58, 123, time.UTC)
 
-	assert.Equal("prefix/2021/01/30/18/random.parquet", S3ParquetKey("prefix/", "random", S3PartitionKey(testTime2)))
+	assert.Equal("prefix/2021/01/30/18/random.parquet", S3ParquetKey("prefix/", "random", PartitionScheme{}.Key(testTime2)))
+}
+
+func TestParquetFileName(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Date(2024, 1, 2, 15, 4, 5, 0, time.FixedZone("CET", 3600))
+	assert.Equal("jaeger-collector-0-20240102T140405Z-000042", ParquetFileName("jaeger-collector-0", start, 42))
+	assert.Equal("spans/2024/01/02/15/host-20240102T140405Z-000000.parquet", S3ParquetKey("spans/", ParquetFileName("host", start, 0), "2024/01/02/15"))
+}
+
+func TestSanitizeInstanceID(t *testing.T) {
+	assert.Equal(t, "jaeger-collector-0.example_com_", SanitizeInstanceID("jaeger-collector-0.example/com?"))
 }
 
 func localTestObjects(test *S3PutTest, assert *assert.Assertions) func(_ context.Context, input *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
@@ -202,8 +218,13 @@ func TestWriteSpan(t *testing.T) {
 	assert.Equal(int64(100000), record.Duration)
 	assert.Equal(map[string]string{}, record.Tags)
 	assert.Equal("example-service-1", record.ServiceName)
-	assert.Equal("/wYAAHNOYVBwWQBZAAB5D7oLeggKEAA2AQAIERIIDRGwAxoTZXhhbXBsZS1vcGVyYXRpb24tMTIMCOfPqMQFELjvjrECOgQQoI0GSg4KMhYAAEo6EAAMUhMKERFLIHNlcnZpY2UtMQ==", record.SpanPayload)
 	assert.Equal([]SpanRecordReferences{}, record.References)
+	assert.Equal(int32(SCHEMA_VERSION_PARENT_SPAN_ID), record.SchemaVersion)
+
+	payloadSpan, err := DecodeSpanPayload([]byte(record.SpanPayload))
+	assert.NoError(err)
+	assert.Equal(span.SpanID, payloadSpan.SpanID)
+	assert.Equal(span.OperationName, payloadSpan.OperationName)
 
 	pr.ReadStop()
 	assert.NoError(localFileReader.Close())
@@ -348,7 +369,13 @@ func TestWriteSpanWithTagsAndReferences(t *testing.T) {
 	assert.Equal(int64(2000), record.Duration)
 	assert.Equal(map[string]string{
 		"blob": "00003039", "sameplacetag1": "sameplacevalue", "sameplacetag2": "123", "sameplacetag3": "72.5", "sameplacetag4": "true",
-	}, record.Tags)
+	}, record.SpanTags)
+	assert.Empty(record.Tags)
+	assert.Empty(record.ProcessTags)
+	assert.Empty(record.Logs)
+	assert.Equal(map[string]int64{"sameplacetag2": 123}, record.IntTags)
+	assert.Equal(map[string]float64{"sameplacetag3": 72.5}, record.FloatTags)
+	assert.Equal(map[string]bool{"sameplacetag4": true}, record.BoolTags)
 	assert.Equal("query12-service", record.ServiceName)
 	assert.Equal([]SpanRecordReferences{
 		{TraceID: "00000000000000ff", SpanID: "00000000000000ff", RefType: 0},
@@ -400,3 +427,158 @@ func BenchmarkWriteSpanParallel(b *testing.B) {
 		}
 	})
 }
+
+func TestWriteSpanWithProcessTagsAndLogs(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	directory := t.TempDir()
+
+	writer, err := NewWriter(ctx, hclog.NewNullLogger(), metrics.NullFactory, nil, config.S3{
+		SpansPrefix:      "spans/",
+		OperationsPrefix: "operations/",
+		LocalDirectory:   directory,
+		PromotedTags:     []string{"error", "hostname", "event", "k8s.namespace"},
+	}, PartitionScheme{})
+	assert.NoError(err)
+
+	span := NewTestSpan(assert)
+	span.Tags = []model.KeyValue{model.Bool("error", true), model.Int64("http.status_code", 500)}
+	span.Process.Tags = []model.KeyValue{model.String("hostname", "host-1"), model.Int64("http.status_code", 200)}
+	span.Logs = []model.Log{
+		{
+			Timestamp: span.StartTime.Add(time.Millisecond),
+			Fields:    []model.KeyValue{model.String("event", "retry"), model.String("error", "timeout"), model.Int64("http.status_code", 0)},
+		},
+		{
+			Timestamp: span.StartTime.Add(2 * time.Millisecond),
+			Fields:    []model.KeyValue{model.String("event", "done")},
+		},
+	}
+
+	assert.NoError(writer.WriteSpan(ctx, span))
+	assert.NoError(writer.Close())
+
+	files, err := filepath.Glob(filepath.Join(directory, "spans", "*", "*", "*", "*", "*.parquet"))
+	assert.NoError(err)
+	assert.Len(files, 1)
+
+	localFileReader, err := local.NewLocalFileReader(files[0])
+	assert.NoError(err)
+	pr, err := reader.NewParquetReader(localFileReader, new(SpanRecord), 1)
+	assert.NoError(err)
+
+	records := make([]SpanRecord, 1)
+	assert.NoError(pr.Read(&records))
+
+	record := records[0]
+
+	// The log field doesn't overwrite the span tag
+	assert.Equal(map[string]string{"error": "true", "http.status_code": "500"}, record.SpanTags)
+	assert.Equal(map[string]string{"hostname": "host-1", "http.status_code": "200"}, record.ProcessTags)
+	assert.Equal([]SpanRecordLog{
+		{Timestamp: span.StartTime.Add(time.Millisecond).UnixMilli(), Fields: map[string]string{"event": "retry", "error": "timeout", "http.status_code": "0"}},
+		{Timestamp: span.StartTime.Add(2 * time.Millisecond).UnixMilli(), Fields: map[string]string{"event": "done"}},
+	}, record.Logs)
+
+	// Only span tags are stored with their type
+	assert.Equal(map[string]int64{"http.status_code": 500}, record.IntTags)
+	assert.Equal(map[string]bool{"error": true}, record.BoolTags)
+
+	pr.ReadStop()
+	assert.NoError(localFileReader.Close())
+
+	localFileReader, err = local.NewLocalFileReader(files[0])
+	assert.NoError(err)
+	pr, err = reader.NewParquetReader(localFileReader, new(promotedTagsRecord), 1)
+	assert.NoError(err)
+
+	promotedTagsRecords := make([]promotedTagsRecord, 1)
+	assert.NoError(pr.Read(&promotedTagsRecords))
+
+	// Span tags take precedence over process tags and the first log field
+	assert.Equal(promotedTagsRecord{
+		TagError:        aws.String("true"),
+		TagHostname:     aws.String("host-1"),
+		TagEvent:        aws.String("retry"),
+		TagK8sNamespace: nil,
+	}, promotedTagsRecords[0])
+
+	pr.ReadStop()
+	assert.NoError(localFileReader.Close())
+}
+
+type promotedTagsRecord struct {
+	TagError        *string `parquet:"name=tag_error, type=BYTE_ARRAY, convertedtype=UTF8"`
+	TagHostname     *string `parquet:"name=tag_hostname, type=BYTE_ARRAY, convertedtype=UTF8"`
+	TagEvent        *string `parquet:"name=tag_event, type=BYTE_ARRAY, convertedtype=UTF8"`
+	TagK8sNamespace *string `parquet:"name=tag_k8s_namespace, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+func TestWriteSpanUnlistedService(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.TODO()
+
+	directory := t.TempDir()
+	metricsFactory := metricstest.NewFactory(0)
+
+	partitions, err := NewPartitionScheme(config.Partitioning{ServiceName: true, ServiceNames: []string{"frontend"}})
+	assert.NoError(err)
+
+	writer, err := NewWriter(ctx, hclog.NewNullLogger(), metricsFactory, nil, config.S3{
+		SpansPrefix:      "spans/",
+		OperationsPrefix: "operations/",
+		LocalDirectory:   directory,
+	}, partitions)
+	assert.NoError(err)
+
+	span := NewTestSpan(assert)
+	frontendSpan := NewTestSpan(assert)
+	frontendSpan.Process.ServiceName = "frontend"
+
+	assert.NoError(writer.WriteSpan(ctx, span))
+	assert.NoError(writer.WriteSpan(ctx, span))
+	assert.NoError(writer.WriteSpan(ctx, frontendSpan))
+	assert.NoError(writer.Close())
+
+	partition := filepath.Join(directory, "spans", filepath.FromSlash(partitions.Key(span.StartTime)))
+	for _, servicePartition := range []string{"frontend", OtherServicePartition} {
+		files, err := filepath.Glob(filepath.Join(partition, servicePartition, "*.parquet"))
+		assert.NoError(err)
+		assert.Len(files, 1, servicePartition)
+	}
+
+	metricsFactory.AssertCounterMetrics(t,
+		metricstest.ExpectedMetric{Name: "spans_unlisted_service", Value: 2},
+	)
+}
+
+func TestSpanRecordParentSpanID(t *testing.T) {
+	assert := assert.New(t)
+
+	span := NewTestSpanWithTagsAndReferences(assert)
+
+	// References into other traces aren't parents
+	record, err := NewSpanRecordFromSpan(span, nil)
+	assert.NoError(err)
+	assert.Equal("", record.ParentSpanID)
+	assert.True(record.IsRoot)
+	assert.True(record.HasOtherReferences)
+
+	span.References = append(span.References, model.NewFollowsFromRef(span.TraceID, model.NewSpanID(1)), model.NewChildOfRef(span.TraceID, model.NewSpanID(2)))
+
+	record, err = NewSpanRecordFromSpan(span, nil)
+	assert.NoError(err)
+	assert.Equal(model.NewSpanID(2).String(), record.ParentSpanID)
+	assert.False(record.IsRoot)
+	assert.True(record.HasOtherReferences)
+
+	// Only the parent span is referenced
+	span.References = []model.SpanRef{model.NewChildOfRef(span.TraceID, model.NewSpanID(2))}
+
+	record, err = NewSpanRecordFromSpan(span, nil)
+	assert.NoError(err)
+	assert.Equal(model.NewSpanID(2).String(), record.ParentSpanID)
+	assert.False(record.IsRoot)
+	assert.False(record.HasOtherReferences)
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -13,11 +15,44 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/glue"
 	glueTypes "github.com/aws/aws-sdk-go-v2/service/glue/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	pluginConfig "github.com/johanneswuerbach/jaeger-s3/plugin/config"
+	"github.com/johanneswuerbach/jaeger-s3/plugin/s3spanstore"
 )
 
 func main() {
+	partitionGranularity := flag.String("partition-granularity", "hour", "granularity of the datehour partition, one of hour, day or 15m")
+	partitionServiceName := flag.Bool("partition-service-name", false, "partition the spans and operations tables by service name")
+	serviceNames := flag.String("service-names", "", "comma separated service names enumerated by the service partition projection, required with -partition-service-name, must match partitioning.serviceNames")
+	promotedTags := flag.String("promoted-tags", "", "comma separated tag keys written into dedicated columns, must match s3.promotedTags")
+	flag.Parse()
+
 	ctx := context.Background()
 
+	var projectedServiceNames []string
+	if *serviceNames != "" {
+		projectedServiceNames = strings.Split(*serviceNames, ",")
+	}
+
+	// Fail before creating any resources
+	partitions, err := s3spanstore.NewPartitionScheme(pluginConfig.Partitioning{
+		Granularity:  *partitionGranularity,
+		ServiceName:  *partitionServiceName,
+		ServiceNames: projectedServiceNames,
+	})
+	if err != nil {
+		log.Fatalf("unable to create partition scheme, %v", err)
+	}
+
+	var promotedTagKeys []string
+	if *promotedTags != "" {
+		promotedTagKeys = strings.Split(*promotedTags, ",")
+	}
+
+	promotedColumns, err := promotedTagColumns(promotedTagKeys)
+	if err != nil {
+		log.Fatalf("unable to create promoted tag columns, %v", err)
+	}
+
 	cfg, err := config.LoadDefaultConfig(ctx, func(lo *config.LoadOptions) error {
 		return nil
 	})
@@ -58,10 +93,14 @@ func main() {
 		}
 	}
 
+	createSpansTable(ctx, glueSvc, partitions, promotedColumns, "jaeger_spans", fmt.Sprintf("s3://%s/spans/", bucketName))
+	// Archived traces aren't partitioned by service
+	createSpansTable(ctx, glueSvc, partitions.WithoutServiceName(), promotedColumns, "jaeger_spans_archive", fmt.Sprintf("s3://%s/spans-archive/", bucketName))
+
 	_, err = glueSvc.DeleteTable(ctx, &glue.DeleteTableInput{
 		DatabaseName: aws.String("default"),
 
-		Name: aws.String("jaeger_spans"),
+		Name: aws.String("jaeger_operations"),
 	})
 	if err != nil {
 		var bne *glueTypes.EntityNotFoundException
@@ -74,28 +113,14 @@ func main() {
 		DatabaseName: aws.String("default"),
 
 		TableInput: &glueTypes.TableInput{
-			Name: aws.String("jaeger_spans"),
-
-			Parameters: map[string]string{
-				"classification":                    "parquet",
-				"projection.enabled":                "true",
-				"projection.datehour.type":          "date",
-				"projection.datehour.format":        "yyyy/MM/dd/HH",
-				"projection.datehour.range":         "2022/01/01/00,NOW",
-				"projection.datehour.interval":      "1",
-				"projection.datehour.interval.unit": "HOURS",
-				"storage.location.template":         fmt.Sprintf("s3://%s/spans/${datehour}/", bucketName),
-			},
+			Name: aws.String("jaeger_operations"),
 
-			PartitionKeys: []glueTypes.Column{
-				{
-					Name: aws.String("datehour"),
-					Type: aws.String("string"),
-				},
-			},
+			Parameters: tableParameters(partitions, fmt.Sprintf("s3://%s/operations/", bucketName)),
+
+			PartitionKeys: partitionKeys(partitions),
 
 			StorageDescriptor: &glueTypes.StorageDescriptor{
-				Location:     aws.String(fmt.Sprintf("s3://%s/spans/", bucketName)),
+				Location:     aws.String(fmt.Sprintf("s3://%s/operations/", bucketName)),
 				InputFormat:  aws.String("org.apache.hadoop.hive.ql.io.parquet.MapredParquetInputFormat"),
 				OutputFormat: aws.String("org.apache.hadoop.hive.ql.io.parquet.MapredParquetOutputFormat"),
 
@@ -107,14 +132,6 @@ func main() {
 				},
 
 				Columns: []glueTypes.Column{
-					{
-						Name: aws.String("trace_id"),
-						Type: aws.String("string"),
-					},
-					{
-						Name: aws.String("span_id"),
-						Type: aws.String("string"),
-					},
 					{
 						Name: aws.String("operation_name"),
 						Type: aws.String("string"),
@@ -123,18 +140,6 @@ func main() {
 						Name: aws.String("span_kind"),
 						Type: aws.String("string"),
 					},
-					{
-						Name: aws.String("start_time"),
-						Type: aws.String("timestamp"),
-					},
-					{
-						Name: aws.String("duration"),
-						Type: aws.String("bigint"),
-					},
-					{
-						Name: aws.String("tags"),
-						Type: aws.String("map<string,string>"),
-					},
 					{
 						Name: aws.String("service_name"),
 						Type: aws.String("string"),
@@ -143,10 +148,6 @@ func main() {
 						Name: aws.String("span_payload"),
 						Type: aws.String("string"),
 					},
-					{
-						Name: aws.String("references"),
-						Type: aws.String("array<struct<trace_id:string,span_id:string,ref_type:tinyint>>"),
-					},
 				},
 			},
 		},
@@ -155,10 +156,71 @@ func main() {
 		log.Fatalf("unable to create glue table, %v", err)
 	}
 
-	_, err = glueSvc.DeleteTable(ctx, &glue.DeleteTableInput{
+	_, err = athenaSvc.CreateWorkGroup(ctx, &athena.CreateWorkGroupInput{
+		Name: aws.String("jaeger"),
+		Configuration: &athenaTypes.WorkGroupConfiguration{
+			ResultConfiguration: &athenaTypes.ResultConfiguration{
+				OutputLocation: aws.String(fmt.Sprintf("s3://%s/", bucketNameResults)),
+			},
+		},
+	})
+	if err != nil {
+		var bne *athenaTypes.InvalidRequestException
+		if !errors.As(err, &bne) {
+			log.Fatalf("unable to create jaeger work group, %v", err)
+		}
+	}
+}
+
+// tableParameters enables the partition projection of the partitions below location
+func tableParameters(partitions s3spanstore.PartitionScheme, location string) map[string]string {
+	parameters := map[string]string{
+		"classification":            "parquet",
+		"projection.enabled":        "true",
+		"storage.location.template": partitions.LocationTemplate(location),
+	}
+	for key, value := range partitions.ProjectionParameters() {
+		parameters[key] = value
+	}
+
+	return parameters
+}
+
+func partitionKeys(partitions s3spanstore.PartitionScheme) []glueTypes.Column {
+	columns := []glueTypes.Column{}
+	for _, name := range partitions.PartitionColumns() {
+		columns = append(columns, glueTypes.Column{
+			Name: aws.String(name),
+			Type: aws.String("string"),
+		})
+	}
+
+	return columns
+}
+
+// promotedTagColumns returns the columns written for the promoted tag keys
+func promotedTagColumns(keys []string) ([]glueTypes.Column, error) {
+	names, err := s3spanstore.PromotedTagColumns(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := []glueTypes.Column{}
+	for _, name := range names {
+		columns = append(columns, glueTypes.Column{
+			Name: aws.String(name),
+			Type: aws.String("string"),
+		})
+	}
+
+	return columns, nil
+}
+
+func createSpansTable(ctx context.Context, glueSvc *glue.Client, partitions s3spanstore.PartitionScheme, promotedColumns []glueTypes.Column, tableName string, location string) {
+	_, err := glueSvc.DeleteTable(ctx, &glue.DeleteTableInput{
 		DatabaseName: aws.String("default"),
 
-		Name: aws.String("jaeger_operations"),
+		Name: aws.String(tableName),
 	})
 	if err != nil {
 		var bne *glueTypes.EntityNotFoundException
@@ -171,28 +233,14 @@ func main() {
 		DatabaseName: aws.String("default"),
 
 		TableInput: &glueTypes.TableInput{
-			Name: aws.String("jaeger_operations"),
+			Name: aws.String(tableName),
 
-			Parameters: map[string]string{
-				"classification":                    "parquet",
-				"projection.enabled":                "true",
-				"projection.datehour.type":          "date",
-				"projection.datehour.format":        "yyyy/MM/dd/HH",
-				"projection.datehour.range":         "2022/01/01/00,NOW",
-				"projection.datehour.interval":      "1",
-				"projection.datehour.interval.unit": "HOURS",
-				"storage.location.template":         fmt.Sprintf("s3://%s/operations/${datehour}/", bucketName),
-			},
+			Parameters: tableParameters(partitions, location),
 
-			PartitionKeys: []glueTypes.Column{
-				{
-					Name: aws.String("datehour"),
-					Type: aws.String("string"),
-				},
-			},
+			PartitionKeys: partitionKeys(partitions),
 
 			StorageDescriptor: &glueTypes.StorageDescriptor{
-				Location:     aws.String(fmt.Sprintf("s3://%s/operations/", bucketName)),
+				Location:     aws.String(location),
 				InputFormat:  aws.String("org.apache.hadoop.hive.ql.io.parquet.MapredParquetInputFormat"),
 				OutputFormat: aws.String("org.apache.hadoop.hive.ql.io.parquet.MapredParquetOutputFormat"),
 
@@ -203,7 +251,27 @@ func main() {
 					},
 				},
 
-				Columns: []glueTypes.Column{
+				Columns: append([]glueTypes.Column{
+					{
+						Name: aws.String("trace_id"),
+						Type: aws.String("string"),
+					},
+					{
+						Name: aws.String("span_id"),
+						Type: aws.String("string"),
+					},
+					{
+						Name: aws.String("parent_span_id"),
+						Type: aws.String("string"),
+					},
+					{
+						Name: aws.String("is_root"),
+						Type: aws.String("boolean"),
+					},
+					{
+						Name: aws.String("has_other_references"),
+						Type: aws.String("boolean"),
+					},
 					{
 						Name: aws.String("operation_name"),
 						Type: aws.String("string"),
@@ -212,34 +280,63 @@ func main() {
 						Name: aws.String("span_kind"),
 						Type: aws.String("string"),
 					},
+					{
+						Name: aws.String("start_time"),
+						Type: aws.String("timestamp"),
+					},
+					{
+						Name: aws.String("duration"),
+						Type: aws.String("bigint"),
+					},
+					{
+						Name: aws.String("tags"),
+						Type: aws.String("map<string,string>"),
+					},
+					{
+						Name: aws.String("span_tags"),
+						Type: aws.String("map<string,string>"),
+					},
+					{
+						Name: aws.String("process_tags"),
+						Type: aws.String("map<string,string>"),
+					},
+					{
+						Name: aws.String("logs"),
+						Type: aws.String("array<struct<timestamp:timestamp,fields:map<string,string>>>"),
+					},
+					{
+						Name: aws.String("int_tags"),
+						Type: aws.String("map<string,bigint>"),
+					},
+					{
+						Name: aws.String("float_tags"),
+						Type: aws.String("map<string,double>"),
+					},
+					{
+						Name: aws.String("bool_tags"),
+						Type: aws.String("map<string,boolean>"),
+					},
 					{
 						Name: aws.String("service_name"),
 						Type: aws.String("string"),
 					},
 					{
 						Name: aws.String("span_payload"),
-						Type: aws.String("string"),
+						Type: aws.String("binary"),
 					},
-				},
+					{
+						Name: aws.String("references"),
+						Type: aws.String("array<struct<trace_id:string,span_id:string,ref_type:tinyint>>"),
+					},
+					{
+						Name: aws.String("schema_version"),
+						Type: aws.String("int"),
+					},
+				}, promotedColumns...),
 			},
 		},
 	})
 	if err != nil {
 		log.Fatalf("unable to create glue table, %v", err)
 	}
-
-	_, err = athenaSvc.CreateWorkGroup(ctx, &athena.CreateWorkGroupInput{
-		Name: aws.String("jaeger"),
-		Configuration: &athenaTypes.WorkGroupConfiguration{
-			ResultConfiguration: &athenaTypes.ResultConfiguration{
-				OutputLocation: aws.String(fmt.Sprintf("s3://%s/", bucketNameResults)),
-			},
-		},
-	})
-	if err != nil {
-		var bne *athenaTypes.InvalidRequestException
-		if !errors.As(err, &bne) {
-			log.Fatalf("unable to create jaeger work group, %v", err)
-		}
-	}
 }